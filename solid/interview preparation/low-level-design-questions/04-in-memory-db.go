@@ -2,9 +2,26 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"container/list"
+	"context"
+	"crypto/rand"
+	"encoding"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -14,6 +31,87 @@ type entry struct {
 	expiry time.Time
 }
 
+// Clock is the store's source of time. Tests and demos use ManualClock so TTLs
+// can be crossed without sleeping.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTimer(d time.Duration) Timer { return realTimer{time.NewTimer(d)} }
+
+type realTimer struct{ t *time.Timer }
+
+func (t realTimer) C() <-chan time.Time { return t.t.C }
+func (t realTimer) Stop() bool          { return t.t.Stop() }
+
+// ManualClock only moves when Advance is called; timers fire as the clock
+// passes their deadline.
+type ManualClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers map[*manualTimer]struct{}
+}
+
+func NewManualClock(start time.Time) *ManualClock {
+	return &ManualClock{now: start, timers: make(map[*manualTimer]struct{})}
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	for t := range c.timers {
+		if !t.when.After(c.now) {
+			t.ch <- c.now
+			delete(c.timers, t)
+		}
+	}
+}
+
+func (c *ManualClock) NewTimer(d time.Duration) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &manualTimer{clock: c, when: c.now.Add(d), ch: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.ch <- c.now
+	} else {
+		c.timers[t] = struct{}{}
+	}
+	return t
+}
+
+type manualTimer struct {
+	clock *ManualClock
+	when  time.Time
+	ch    chan time.Time
+}
+
+func (t *manualTimer) C() <-chan time.Time { return t.ch }
+
+func (t *manualTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	_, pending := t.clock.timers[t]
+	delete(t.clock.timers, t)
+	return pending
+}
+
 type EvictionPolicy interface {
 	OnPut(key string)
 	OnGet(key string)
@@ -90,29 +188,191 @@ type Store interface {
 	Put(key string, val any, ttl time.Duration) error
 	Get(key string) (any, error)
 	Delete(key string) error
+	PutCtx(ctx context.Context, key string, val any, ttl time.Duration) error
+	GetCtx(ctx context.Context, key string) (any, error)
+	DeleteCtx(ctx context.Context, key string) error
 	Size() int
+	TTL(key string) (time.Duration, error)
+	Items() []Item
+	Stats() StoreStats
+}
+
+// Item is a live entry as seen by Items; TTL is the time remaining, or zero
+// when the entry never expires.
+type Item struct {
+	Key   string
+	Value any
+	TTL   time.Duration
+}
+
+type StoreStats struct {
+	Keys        int
+	Hits        int
+	Misses      int
+	Evictions   int
+	Expirations int
+	Loads       int
+}
+
+// Loader fills a miss in GetCtx, returning the value and the TTL to keep it
+// for. It runs without the caller's cancellation so that a load shared by
+// several callers is not cut short by whichever of them gives up first. A
+// Put or Delete of the key made while it runs wins over what it loads.
+type Loader func(ctx context.Context, key string) (any, time.Duration, error)
+
+type loadCall struct {
+	done chan struct{}
+	val  any
+	err  error
+
+	// written is set, under the store's mu, by a Put or Delete of the key
+	// while the load runs; the loaded value is then older than the store.
+	written bool
+}
+
+// ctxRWMutex is a writer-preferring RW lock whose acquisition gives up when
+// the context ends. Lock and RLock cannot fail for context.Background().
+type ctxRWMutex struct {
+	mu       sync.Mutex
+	readers  int
+	writer   bool
+	queuedW  int
+	released chan struct{}
+}
+
+func (m *ctxRWMutex) wait(ctx context.Context) error {
+	if m.released == nil {
+		m.released = make(chan struct{})
+	}
+	ch := m.released
+	m.mu.Unlock()
+	select {
+	case <-ch:
+		m.mu.Lock()
+		return nil
+	case <-ctx.Done():
+		m.mu.Lock()
+		return ctx.Err()
+	}
+}
+
+func (m *ctxRWMutex) broadcast() {
+	if m.released != nil {
+		close(m.released)
+		m.released = nil
+	}
+}
+
+func (m *ctxRWMutex) Lock(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queuedW++
+	defer func() { m.queuedW-- }()
+	for m.writer || m.readers > 0 {
+		if err := m.wait(ctx); err != nil {
+			m.broadcast() // readers may have been held back by us
+			return err
+		}
+	}
+	m.writer = true
+	return nil
+}
+
+func (m *ctxRWMutex) Unlock() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.writer = false
+	m.broadcast()
+}
+
+func (m *ctxRWMutex) RLock(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for m.writer || m.queuedW > 0 {
+		if err := m.wait(ctx); err != nil {
+			return err
+		}
+	}
+	m.readers++
+	return nil
+}
+
+func (m *ctxRWMutex) RUnlock() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.readers--; m.readers == 0 {
+		m.broadcast()
+	}
 }
 
 type inMemStore struct {
-	mu      sync.RWMutex
+	mu      ctxRWMutex
 	data    map[string]entry
 	evictor EvictionPolicy
+	clock   Clock
+	loader  Loader
+	stats   StoreStats
+
+	loadMu sync.Mutex
+	loads  map[string]*loadCall
+}
+
+type StoreOption func(*inMemStore)
+
+func WithClock(c Clock) StoreOption {
+	return func(s *inMemStore) {
+		if c != nil {
+			s.clock = c
+		}
+	}
+}
+
+// WithLoader makes the store read-through: GetCtx misses call l, with
+// concurrent misses on one key sharing a single load.
+func WithLoader(l Loader) StoreOption {
+	return func(s *inMemStore) { s.loader = l }
 }
 
-func NewInMemoryStore(capacity int, ev EvictionPolicy) (Store, error) {
+func NewInMemoryStore(capacity int, ev EvictionPolicy, opts ...StoreOption) (Store, error) {
 	if capacity <= 0 {
 		return nil, ErrInvalidCap
 	}
 	if ev == nil {
 		return nil, ErrEvictionNil
 	}
-	return &inMemStore{
+	s := &inMemStore{
 		data:    make(map[string]entry),
 		evictor: ev,
-	}, nil
+		clock:   realClock{},
+		loads:   make(map[string]*loadCall),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s, nil
 }
 
+func (s *inMemStore) Clock() Clock { return s.clock }
+
 func (s *inMemStore) Put(key string, val any, ttl time.Duration) error {
+	return s.PutCtx(context.Background(), key, val, ttl)
+}
+
+func (s *inMemStore) Get(key string) (any, error) {
+	return s.GetCtx(context.Background(), key)
+}
+
+func (s *inMemStore) Delete(key string) error {
+	return s.DeleteCtx(context.Background(), key)
+}
+
+func (s *inMemStore) PutCtx(ctx context.Context, key string, val any, ttl time.Duration) error {
 	if err := validateTTL(ttl); err != nil {
 		return err
 	}
@@ -120,58 +380,1287 @@ func (s *inMemStore) Put(key string, val any, ttl time.Duration) error {
 		return ErrNilStoreValue
 	}
 
-	s.mu.Lock()
+	if err := s.mu.Lock(ctx); err != nil {
+		return err
+	}
 	defer s.mu.Unlock()
 
+	s.put(key, val, ttl)
+	s.supersedeLoad(key)
+	return nil
+}
+
+// put stores an entry and evicts what no longer fits. Callers hold mu.
+func (s *inMemStore) put(key string, val any, ttl time.Duration) {
 	exp := time.Time{}
 	if ttl > 0 {
-		exp = time.Now().Add(ttl)
+		exp = s.clock.Now().Add(ttl)
 	}
 
 	s.data[key] = entry{value: val, expiry: exp}
 	s.evictor.OnPut(key)
+	before := len(s.data)
 	s.evictor.Evict(s.data)
-	return nil
+	s.stats.Evictions += before - len(s.data)
 }
 
-func (s *inMemStore) Get(key string) (any, error) {
-	s.mu.Lock()
+// supersedeLoad tells an in-flight load of key that the key was written
+// meanwhile. Callers hold mu.
+func (s *inMemStore) supersedeLoad(key string) {
+	if s.loader == nil {
+		return
+	}
+	s.loadMu.Lock()
+	if call := s.loads[key]; call != nil {
+		call.written = true
+	}
+	s.loadMu.Unlock()
+}
+
+func (s *inMemStore) GetCtx(ctx context.Context, key string) (any, error) {
+	val, err := s.lookup(ctx, key)
+	if !errors.Is(err, ErrKeyNotFound) || s.loader == nil {
+		return val, err
+	}
+	return s.load(ctx, key)
+}
+
+func (s *inMemStore) lookup(ctx context.Context, key string) (any, error) {
+	if err := s.mu.Lock(ctx); err != nil {
+		return nil, err
+	}
 	defer s.mu.Unlock()
 
 	ent, ok := s.data[key]
 	if !ok {
+		s.stats.Misses++
 		return nil, ErrKeyNotFound
 	}
-	if ent.expiry.IsZero() || ent.expiry.After(time.Now()) {
+	if ent.expiry.IsZero() || ent.expiry.After(s.clock.Now()) {
+		s.stats.Hits++
 		s.evictor.OnGet(key)
 		return ent.value, nil
 	}
 
 	delete(s.data, key)
 	s.evictor.OnDelete(key)
+	s.stats.Misses++
+	s.stats.Expirations++
 	return nil, ErrKeyNotFound
 }
 
-func (s *inMemStore) Delete(key string) error {
-	s.mu.Lock()
+// load joins or starts the in-flight load for key and waits for it, or for
+// ctx, whichever comes first. An abandoned load still fills the store.
+func (s *inMemStore) load(ctx context.Context, key string) (any, error) {
+	s.loadMu.Lock()
+	call, ok := s.loads[key]
+	if !ok {
+		call = &loadCall{done: make(chan struct{})}
+		s.loads[key] = call
+		go s.runLoad(context.WithoutCancel(ctx), key, call)
+	}
+	s.loadMu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.val, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (s *inMemStore) runLoad(ctx context.Context, key string, call *loadCall) {
+	val, ttl, err := s.loader(ctx, key)
+	if err == nil {
+		val, err = s.putLoaded(ctx, key, val, ttl, call)
+	}
+	if err != nil {
+		val = nil
+	}
+	call.val, call.err = val, err
+
+	s.loadMu.Lock()
+	delete(s.loads, key)
+	s.loadMu.Unlock()
+	close(call.done)
+}
+
+// putLoaded stores what the loader returned, unless the key was written
+// while it loaded: then the write stands, and the callers get the value it
+// put, or after a delete the loaded value without it being kept.
+func (s *inMemStore) putLoaded(ctx context.Context, key string, val any, ttl time.Duration, call *loadCall) (any, error) {
+	if err := validateTTL(ttl); err != nil {
+		return nil, err
+	}
+	if val == nil {
+		return nil, ErrNilStoreValue
+	}
+
+	if err := s.mu.Lock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	s.stats.Loads++
+	if ent, ok := s.data[key]; ok && (ent.expiry.IsZero() || ent.expiry.After(s.clock.Now())) {
+		return ent.value, nil
+	}
+	if !call.written {
+		s.put(key, val, ttl)
+	}
+	return val, nil
+}
+
+func (s *inMemStore) DeleteCtx(ctx context.Context, key string) error {
+	if err := s.mu.Lock(ctx); err != nil {
+		return err
+	}
 	defer s.mu.Unlock()
 	if _, ok := s.data[key]; !ok {
 		return ErrKeyNotFound
 	}
 	delete(s.data, key)
 	s.evictor.OnDelete(key)
+	s.supersedeLoad(key)
 	return nil
 }
 
 func (s *inMemStore) Size() int {
-	s.mu.RLock()
+	s.mu.RLock(context.Background())
 	defer s.mu.RUnlock()
 	return len(s.data)
 }
 
+func (s *inMemStore) TTL(key string) (time.Duration, error) {
+	s.mu.RLock(context.Background())
+	defer s.mu.RUnlock()
+	ent, ok := s.data[key]
+	if !ok {
+		return 0, ErrKeyNotFound
+	}
+	if ent.expiry.IsZero() {
+		return 0, nil
+	}
+	left := ent.expiry.Sub(s.clock.Now())
+	if left <= 0 {
+		return 0, ErrKeyNotFound
+	}
+	return left, nil
+}
+
+// Items returns the live entries sorted by key without touching the eviction
+// order, so a dump does not make every key look recently used.
+func (s *inMemStore) Items() []Item {
+	s.mu.RLock(context.Background())
+	defer s.mu.RUnlock()
+	now := s.clock.Now()
+	items := make([]Item, 0, len(s.data))
+	for k, ent := range s.data {
+		it := Item{Key: k, Value: ent.value}
+		if !ent.expiry.IsZero() {
+			if it.TTL = ent.expiry.Sub(now); it.TTL <= 0 {
+				continue
+			}
+		}
+		items = append(items, it)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Key < items[j].Key })
+	return items
+}
+
+func (s *inMemStore) Stats() StoreStats {
+	s.mu.RLock(context.Background())
+	defer s.mu.RUnlock()
+	st := s.stats
+	st.Keys = len(s.data)
+	return st
+}
+
+var (
+	ErrLockHeld      = errors.New("lock is held by another owner")
+	ErrNotLockOwner  = errors.New("lease is not held by this owner")
+	ErrLeaseTTL      = errors.New("lease ttl must be positive")
+	ErrNilLockStore  = errors.New("lock store cannot be nil")
+	ErrInvalidLockID = errors.New("lock name must be non-empty and contain no spaces")
+)
+
+// Lease is a time-bounded grant of a named lock. Fence increases with every
+// grant across the whole service, so a resource can reject writes carrying a
+// fence older than the newest one it has seen.
+type Lease struct {
+	Name   string
+	Owner  string
+	Fence  uint64
+	Expiry time.Time
+}
+
+type lockGrant struct {
+	lease Lease
+	err   error
+}
+
+type lockWaiter struct {
+	ttl   time.Duration
+	ready chan lockGrant
+}
+
+// LockService keeps leases in a Store under the "lock/" prefix. The store
+// should be dedicated to the service (or at least large enough that the
+// eviction policy never drops a live lease).
+type LockService struct {
+	mu      sync.Mutex
+	store   Store
+	clock   Clock
+	fence   uint64
+	waiters map[string]*list.List
+}
+
+// NewLockService shares the store's clock when it exposes one, so lease
+// expiry and entry TTLs always agree.
+func NewLockService(store Store) (*LockService, error) {
+	if store == nil {
+		return nil, ErrNilLockStore
+	}
+	var clock Clock = realClock{}
+	if cs, ok := store.(interface{ Clock() Clock }); ok {
+		clock = cs.Clock()
+	}
+	return &LockService{
+		store:   store,
+		clock:   clock,
+		waiters: make(map[string]*list.List),
+	}, nil
+}
+
+func lockKey(name string) string { return "lock/" + name }
+
+func validateLock(name string, ttl time.Duration) error {
+	if name == "" || strings.ContainsAny(name, " \t\r\n") {
+		return ErrInvalidLockID
+	}
+	if ttl <= 0 {
+		return ErrLeaseTTL
+	}
+	return nil
+}
+
+func (ls *LockService) current(name string) (Lease, bool) {
+	v, err := ls.store.Get(lockKey(name))
+	if err != nil {
+		return Lease{}, false
+	}
+	l, ok := v.(Lease)
+	if !ok || !l.Expiry.After(ls.clock.Now()) {
+		return Lease{}, false
+	}
+	return l, true
+}
+
+func (ls *LockService) grant(name string, ttl time.Duration) (Lease, error) {
+	ls.fence++
+	l := Lease{
+		Name:   name,
+		Owner:  rand.Text(),
+		Fence:  ls.fence,
+		Expiry: ls.clock.Now().Add(ttl),
+	}
+	if err := ls.store.Put(lockKey(name), l, ttl); err != nil {
+		return Lease{}, err
+	}
+	return l, nil
+}
+
+// handoff grants a free lock to the longest waiting Acquire call.
+func (ls *LockService) handoff(name string) {
+	q := ls.waiters[name]
+	for q != nil && q.Len() > 0 {
+		w := q.Remove(q.Front()).(*lockWaiter)
+		l, err := ls.grant(name, w.ttl)
+		w.ready <- lockGrant{lease: l, err: err}
+		if err == nil {
+			break
+		}
+	}
+	if q != nil && q.Len() == 0 {
+		delete(ls.waiters, name)
+	}
+}
+
+func (ls *LockService) TryAcquire(name string, ttl time.Duration) (Lease, error) {
+	if err := validateLock(name, ttl); err != nil {
+		return Lease{}, err
+	}
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	if _, held := ls.current(name); held {
+		return Lease{}, ErrLockHeld
+	}
+	if q := ls.waiters[name]; q != nil && q.Len() > 0 {
+		ls.handoff(name)
+		return Lease{}, ErrLockHeld
+	}
+	return ls.grant(name, ttl)
+}
+
+// Acquire blocks until the lock is granted or ctx is done. Waiters are served
+// in arrival order, both on Release and when the holder's lease runs out.
+func (ls *LockService) Acquire(ctx context.Context, name string, ttl time.Duration) (Lease, error) {
+	l, err := ls.TryAcquire(name, ttl)
+	if !errors.Is(err, ErrLockHeld) {
+		return l, err
+	}
+
+	w := &lockWaiter{ttl: ttl, ready: make(chan lockGrant, 1)}
+	ls.mu.Lock()
+	q := ls.waiters[name]
+	if q == nil {
+		q = list.New()
+		ls.waiters[name] = q
+	}
+	elem := q.PushBack(w)
+	ls.mu.Unlock()
+
+	for {
+		timer := ls.clock.NewTimer(ls.untilFree(name))
+		select {
+		case g := <-w.ready:
+			timer.Stop()
+			return g.lease, g.err
+		case <-ctx.Done():
+			timer.Stop()
+			ls.abandon(name, elem, w)
+			return Lease{}, ctx.Err()
+		case <-timer.C():
+		}
+	}
+}
+
+// untilFree hands the lock off if its lease has lapsed and reports how long
+// the current holder may still keep it.
+func (ls *LockService) untilFree(name string) time.Duration {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	cur, held := ls.current(name)
+	if !held {
+		ls.handoff(name)
+		if cur, held = ls.current(name); !held {
+			return 0
+		}
+	}
+	return cur.Expiry.Sub(ls.clock.Now())
+}
+
+func (ls *LockService) abandon(name string, elem *list.Element, w *lockWaiter) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if q := ls.waiters[name]; q != nil {
+		q.Remove(elem)
+		if q.Len() == 0 {
+			delete(ls.waiters, name)
+		}
+	}
+	// the lock may have been handed to us just before we gave up; release
+	// it as Release would, unless that grant has lapsed and someone else
+	// holds the lock by now
+	select {
+	case g := <-w.ready:
+		if g.err != nil {
+			break
+		}
+		cur, held := ls.current(name)
+		if held && (cur.Owner != g.lease.Owner || cur.Fence != g.lease.Fence) {
+			break
+		}
+		if held {
+			_ = ls.store.Delete(lockKey(name))
+		}
+		ls.handoff(name)
+	default:
+	}
+}
+
+func (ls *LockService) Renew(l Lease, ttl time.Duration) (Lease, error) {
+	if err := validateLock(l.Name, ttl); err != nil {
+		return Lease{}, err
+	}
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	cur, held := ls.current(l.Name)
+	if !held || cur.Owner != l.Owner || cur.Fence != l.Fence {
+		return Lease{}, ErrNotLockOwner
+	}
+	cur.Expiry = ls.clock.Now().Add(ttl)
+	if err := ls.store.Put(lockKey(l.Name), cur, ttl); err != nil {
+		return Lease{}, err
+	}
+	return cur, nil
+}
+
+func (ls *LockService) Release(l Lease) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	cur, held := ls.current(l.Name)
+	if !held || cur.Owner != l.Owner || cur.Fence != l.Fence {
+		return ErrNotLockOwner
+	}
+	if err := ls.store.Delete(lockKey(l.Name)); err != nil {
+		return err
+	}
+	ls.handoff(l.Name)
+	return nil
+}
+
+// Lock protocol: one request per line, one reply per line.
+//
+//	ACQUIRE <name> <ttl-ms> <wait-ms>     wait-ms 0 tries once without blocking
+//	RENEW <name> <owner> <fence> <ttl-ms>
+//	RELEASE <name> <owner> <fence>
+//
+// A lease reply is "OK <owner> <fence> <expiry-unix-ms>", RELEASE answers a
+// bare "OK", and failures are "ERR <code> <message>".
+var lockErrCodes = map[string]error{
+	"HELD":      ErrLockHeld,
+	"NOT_OWNER": ErrNotLockOwner,
+	"BAD_TTL":   ErrLeaseTTL,
+	"BAD_NAME":  ErrInvalidLockID,
+	"TIMEOUT":   context.DeadlineExceeded,
+}
+
+func lockErrReply(err error) string {
+	for code, e := range lockErrCodes {
+		if errors.Is(err, e) {
+			return fmt.Sprintf("ERR %s %v", code, err)
+		}
+	}
+	return fmt.Sprintf("ERR BAD_REQUEST %v", err)
+}
+
+func leaseReply(l Lease) string {
+	return fmt.Sprintf("OK %s %d %d", l.Owner, l.Fence, l.Expiry.UnixMilli())
+}
+
+type LockServer struct {
+	svc *LockService
+}
+
+func NewLockServer(svc *LockService) *LockServer {
+	return &LockServer{svc: svc}
+}
+
+func (s *LockServer) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *LockServer) handle(conn net.Conn) {
+	defer conn.Close()
+	sc := bufio.NewScanner(conn)
+	for sc.Scan() {
+		if _, err := fmt.Fprintln(conn, s.dispatch(strings.Fields(sc.Text()))); err != nil {
+			return
+		}
+	}
+}
+
+func (s *LockServer) dispatch(args []string) string {
+	if len(args) == 0 {
+		return "ERR BAD_REQUEST empty request"
+	}
+	ms := func(i int) (time.Duration, error) {
+		n, err := strconv.ParseInt(args[i], 10, 64)
+		return time.Duration(n) * time.Millisecond, err
+	}
+	lease := func() (Lease, error) {
+		fence, err := strconv.ParseUint(args[3], 10, 64)
+		return Lease{Name: args[1], Owner: args[2], Fence: fence}, err
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "ACQUIRE":
+		if len(args) != 4 {
+			return "ERR BAD_REQUEST usage: ACQUIRE <name> <ttl-ms> <wait-ms>"
+		}
+		ttl, err1 := ms(2)
+		wait, err2 := ms(3)
+		if err := errors.Join(err1, err2); err != nil {
+			return lockErrReply(err)
+		}
+		var l Lease
+		var err error
+		if wait <= 0 {
+			l, err = s.svc.TryAcquire(args[1], ttl)
+		} else {
+			ctx, cancel := context.WithTimeout(context.Background(), wait)
+			l, err = s.svc.Acquire(ctx, args[1], ttl)
+			cancel()
+		}
+		if err != nil {
+			return lockErrReply(err)
+		}
+		return leaseReply(l)
+	case "RENEW":
+		if len(args) != 5 {
+			return "ERR BAD_REQUEST usage: RENEW <name> <owner> <fence> <ttl-ms>"
+		}
+		l, err1 := lease()
+		ttl, err2 := ms(4)
+		if err := errors.Join(err1, err2); err != nil {
+			return lockErrReply(err)
+		}
+		l, err := s.svc.Renew(l, ttl)
+		if err != nil {
+			return lockErrReply(err)
+		}
+		return leaseReply(l)
+	case "RELEASE":
+		if len(args) != 4 {
+			return "ERR BAD_REQUEST usage: RELEASE <name> <owner> <fence>"
+		}
+		l, err := lease()
+		if err == nil {
+			err = s.svc.Release(l)
+		}
+		if err != nil {
+			return lockErrReply(err)
+		}
+		return "OK"
+	}
+	return fmt.Sprintf("ERR BAD_REQUEST unknown command %q", args[0])
+}
+
+// LockClient talks to a LockServer; it is safe for concurrent use but
+// serialises requests over its single connection.
+type LockClient struct {
+	mu   sync.Mutex
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+func DialLockServer(addr string) (*LockClient, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &LockClient{conn: conn, rd: bufio.NewReader(conn)}, nil
+}
+
+func (c *LockClient) Close() error { return c.conn.Close() }
+
+func (c *LockClient) roundTrip(args ...string) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := fmt.Fprintln(c.conn, strings.Join(args, " ")); err != nil {
+		return nil, err
+	}
+	line, err := c.rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil, errors.New("empty reply from lock server")
+	}
+	if fields[0] == "ERR" {
+		msg := strings.TrimSpace(line)
+		if len(fields) > 1 {
+			if e, ok := lockErrCodes[fields[1]]; ok {
+				return nil, fmt.Errorf("%w (%s)", e, msg)
+			}
+		}
+		return nil, errors.New(msg)
+	}
+	return fields[1:], nil
+}
+
+func (c *LockClient) lease(name string, fields []string) (Lease, error) {
+	if len(fields) != 3 {
+		return Lease{}, fmt.Errorf("malformed lease reply %q", fields)
+	}
+	fence, err1 := strconv.ParseUint(fields[1], 10, 64)
+	exp, err2 := strconv.ParseInt(fields[2], 10, 64)
+	if err := errors.Join(err1, err2); err != nil {
+		return Lease{}, err
+	}
+	return Lease{Name: name, Owner: fields[0], Fence: fence, Expiry: time.UnixMilli(exp)}, nil
+}
+
+// Acquire waits up to wait for the lock; a zero wait makes a single attempt.
+func (c *LockClient) Acquire(name string, ttl, wait time.Duration) (Lease, error) {
+	if err := validateLock(name, ttl); err != nil {
+		return Lease{}, err
+	}
+	fields, err := c.roundTrip("ACQUIRE", name,
+		strconv.FormatInt(ttl.Milliseconds(), 10), strconv.FormatInt(wait.Milliseconds(), 10))
+	if err != nil {
+		return Lease{}, err
+	}
+	return c.lease(name, fields)
+}
+
+func (c *LockClient) Renew(l Lease, ttl time.Duration) (Lease, error) {
+	fields, err := c.roundTrip("RENEW", l.Name, l.Owner,
+		strconv.FormatUint(l.Fence, 10), strconv.FormatInt(ttl.Milliseconds(), 10))
+	if err != nil {
+		return Lease{}, err
+	}
+	return c.lease(l.Name, fields)
+}
+
+func (c *LockClient) Release(l Lease) error {
+	_, err := c.roundTrip("RELEASE", l.Name, l.Owner, strconv.FormatUint(l.Fence, 10))
+	return err
+}
+
+func newLockService() *LockService {
+	store, err := NewInMemoryStore(1024, NewLRUPolicy(1024))
+	if err != nil {
+		panic(err)
+	}
+	svc, err := NewLockService(store)
+	if err != nil {
+		panic(err)
+	}
+	return svc
+}
+
+// runLockDaemon serves locks to other processes on this host:
+//
+//	go run 04-in-memory-db.go lockd 127.0.0.1:7070
+func runLockDaemon(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	fmt.Println("lockd listening on", ln.Addr())
+	return NewLockServer(newLockService()).Serve(ln)
+}
+
+var (
+	ErrUnregisteredType = errors.New("type has no registered codec")
+	ErrUnknownTypeTag   = errors.New("unknown type tag")
+	ErrBadEnvelope      = errors.New("malformed encoded value")
+)
+
+// Codec turns values of one registered Go type into bytes and back. Decode
+// receives the registered type so it can allocate the right target.
+type Codec interface {
+	Name() string
+	Encode(v any) ([]byte, error)
+	Decode(data []byte, typ reflect.Type) (any, error)
+}
+
+type JSONCodec struct{}
+
+func (JSONCodec) Name() string                 { return "json" }
+func (JSONCodec) Encode(v any) ([]byte, error) { return json.Marshal(v) }
+
+func (JSONCodec) Decode(data []byte, typ reflect.Type) (any, error) {
+	ptr := reflect.New(typ)
+	if err := json.Unmarshal(data, ptr.Interface()); err != nil {
+		return nil, err
+	}
+	return ptr.Elem().Interface(), nil
+}
+
+type GobCodec struct{}
+
+func (GobCodec) Name() string { return "gob" }
+
+func (GobCodec) Encode(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec) Decode(data []byte, typ reflect.Type) (any, error) {
+	ptr := reflect.New(typ)
+	if err := gob.NewDecoder(bytes.NewReader(data)).DecodeValue(ptr); err != nil {
+		return nil, err
+	}
+	return ptr.Elem().Interface(), nil
+}
+
+// RawCodec stores []byte and string values as they are.
+type RawCodec struct{}
+
+func (RawCodec) Name() string { return "raw" }
+
+func (RawCodec) Encode(v any) ([]byte, error) {
+	switch b := v.(type) {
+	case []byte:
+		return bytes.Clone(b), nil
+	case string:
+		return []byte(b), nil
+	}
+	return nil, fmt.Errorf("raw codec cannot encode %T", v)
+}
+
+func (RawCodec) Decode(data []byte, typ reflect.Type) (any, error) {
+	switch typ.Kind() {
+	case reflect.Slice:
+		if typ.Elem().Kind() == reflect.Uint8 {
+			return reflect.ValueOf(bytes.Clone(data)).Convert(typ).Interface(), nil
+		}
+	case reflect.String:
+		return reflect.ValueOf(string(data)).Convert(typ).Interface(), nil
+	}
+	return nil, fmt.Errorf("raw codec cannot decode into %v", typ)
+}
+
+// BinaryCodec defers to the value's own encoding.BinaryMarshaler and
+// BinaryUnmarshaler, which is how custom types plug in their own format.
+type BinaryCodec struct{}
+
+func (BinaryCodec) Name() string { return "binary" }
+
+func (BinaryCodec) Encode(v any) ([]byte, error) {
+	m, ok := v.(encoding.BinaryMarshaler)
+	if !ok {
+		return nil, fmt.Errorf("%T does not implement encoding.BinaryMarshaler", v)
+	}
+	return m.MarshalBinary()
+}
+
+func (BinaryCodec) Decode(data []byte, typ reflect.Type) (any, error) {
+	ptr := reflect.New(typ)
+	u, ok := ptr.Interface().(encoding.BinaryUnmarshaler)
+	if !ok {
+		return nil, fmt.Errorf("*%v does not implement encoding.BinaryUnmarshaler", typ)
+	}
+	if err := u.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return ptr.Elem().Interface(), nil
+}
+
+// Encoded is a value after it went through the registry: the type tag picks
+// the Go type and codec on the way back in.
+type Encoded struct {
+	Tag        string
+	Compressed bool
+	Data       []byte
+}
+
+const (
+	envelopeVersion  = 1
+	envelopeGzipFlag = 1 << 0
+)
+
+// MarshalBinary frames the value for the wire or disk as
+// version | flags | uvarint tag length | tag | payload.
+func (e Encoded) MarshalBinary() ([]byte, error) {
+	var flags byte
+	if e.Compressed {
+		flags |= envelopeGzipFlag
+	}
+	out := []byte{envelopeVersion, flags}
+	out = binary.AppendUvarint(out, uint64(len(e.Tag)))
+	out = append(out, e.Tag...)
+	return append(out, e.Data...), nil
+}
+
+func (e *Encoded) UnmarshalBinary(b []byte) error {
+	if len(b) < 2 || b[0] != envelopeVersion {
+		return ErrBadEnvelope
+	}
+	n, sz := binary.Uvarint(b[2:])
+	if sz <= 0 || uint64(len(b)-2-sz) < n {
+		return ErrBadEnvelope
+	}
+	rest := b[2+sz:]
+	e.Compressed = b[1]&envelopeGzipFlag != 0
+	e.Tag = string(rest[:n])
+	e.Data = bytes.Clone(rest[n:])
+	return nil
+}
+
+type registeredType struct {
+	tag   string
+	typ   reflect.Type
+	codec Codec
+}
+
+type CodecRegistry struct {
+	mu            sync.RWMutex
+	byTag         map[string]registeredType
+	byType        map[reflect.Type]registeredType
+	compressAbove int
+}
+
+type RegistryOption func(*CodecRegistry)
+
+// WithCompression gzips payloads larger than threshold bytes.
+func WithCompression(threshold int) RegistryOption {
+	return func(r *CodecRegistry) { r.compressAbove = threshold }
+}
+
+func NewCodecRegistry(opts ...RegistryOption) *CodecRegistry {
+	r := &CodecRegistry{
+		byTag:  make(map[string]registeredType),
+		byType: make(map[reflect.Type]registeredType),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// DefaultCodecRegistry knows the types kvctl produces plus a few common ones.
+func DefaultCodecRegistry(opts ...RegistryOption) *CodecRegistry {
+	r := NewCodecRegistry(opts...)
+	for _, d := range []struct {
+		tag    string
+		sample any
+		codec  Codec
+	}{
+		{"string", "", RawCodec{}},
+		{"bytes", []byte(nil), RawCodec{}},
+		{"bool", false, JSONCodec{}},
+		{"int", 0, JSONCodec{}},
+		{"int64", int64(0), JSONCodec{}},
+		{"float64", 0.0, JSONCodec{}},
+		{"time", time.Time{}, BinaryCodec{}},
+		{"json.object", map[string]any(nil), JSONCodec{}},
+		{"json.array", []any(nil), JSONCodec{}},
+	} {
+		if err := r.Register(d.tag, d.sample, d.codec); err != nil {
+			panic(err)
+		}
+	}
+	return r
+}
+
+// Register binds the dynamic type of sample to tag and codec.
+func (r *CodecRegistry) Register(tag string, sample any, c Codec) error {
+	if tag == "" || sample == nil || c == nil {
+		return errors.New("register needs a tag, a non-nil sample and a codec")
+	}
+	typ := reflect.TypeOf(sample)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, dup := r.byTag[tag]; dup {
+		return fmt.Errorf("type tag %q already registered", tag)
+	}
+	if prev, dup := r.byType[typ]; dup {
+		return fmt.Errorf("%v already registered as %q", typ, prev.tag)
+	}
+	rt := registeredType{tag: tag, typ: typ, codec: c}
+	r.byTag[tag] = rt
+	r.byType[typ] = rt
+	return nil
+}
+
+func (r *CodecRegistry) Encode(v any) (Encoded, error) {
+	r.mu.RLock()
+	rt, ok := r.byType[reflect.TypeOf(v)]
+	r.mu.RUnlock()
+	if !ok {
+		return Encoded{}, fmt.Errorf("%w: %T", ErrUnregisteredType, v)
+	}
+	data, err := rt.codec.Encode(v)
+	if err != nil {
+		return Encoded{}, fmt.Errorf("%s codec: %w", rt.codec.Name(), err)
+	}
+	e := Encoded{Tag: rt.tag, Data: data}
+	if r.compressAbove > 0 && len(data) > r.compressAbove {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(data); err != nil {
+			return Encoded{}, err
+		}
+		if err := zw.Close(); err != nil {
+			return Encoded{}, err
+		}
+		e.Data, e.Compressed = buf.Bytes(), true
+	}
+	return e, nil
+}
+
+func (r *CodecRegistry) Decode(e Encoded) (any, error) {
+	r.mu.RLock()
+	rt, ok := r.byTag[e.Tag]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownTypeTag, e.Tag)
+	}
+	data := e.Data
+	if e.Compressed {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if data, err = io.ReadAll(zr); err != nil {
+			return nil, err
+		}
+	}
+	v, err := rt.codec.Decode(data, rt.typ)
+	if err != nil {
+		return nil, fmt.Errorf("%s codec: %w", rt.codec.Name(), err)
+	}
+	return v, nil
+}
+
+// Marshal and Unmarshal are Encode/Decode plus the binary envelope.
+func (r *CodecRegistry) Marshal(v any) ([]byte, error) {
+	e, err := r.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return e.MarshalBinary()
+}
+
+func (r *CodecRegistry) Unmarshal(b []byte) (any, error) {
+	var e Encoded
+	if err := e.UnmarshalBinary(b); err != nil {
+		return nil, err
+	}
+	return r.Decode(e)
+}
+
+// KeyError reports a single key that could not be exported or imported; the
+// rest of the dump carries on without it.
+type KeyError struct {
+	Key string
+	Err error
+}
+
+func (e KeyError) Error() string { return fmt.Sprintf("key %q: %v", e.Key, e.Err) }
+func (e KeyError) Unwrap() error { return e.Err }
+
+// jsonlRecord is one line of a dump. Without a registry the value is plain
+// JSON in Value; with one, Type is the registry tag and Data the encoded
+// payload, which is left out when empty, as for "". TTLMillis is the time left at export and is omitted for keys that
+// never expire.
+type jsonlRecord struct {
+	Key        string          `json:"key"`
+	Type       string          `json:"type"`
+	Value      json.RawMessage `json:"value,omitempty"`
+	Data       []byte          `json:"data,omitempty"`
+	Compressed bool            `json:"gz,omitempty"`
+	TTLMillis  int64           `json:"ttl_ms,omitempty"`
+}
+
+func encodeRecord(key string, v any, reg *CodecRegistry) (jsonlRecord, error) {
+	if reg == nil {
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return jsonlRecord{}, fmt.Errorf("encode %T: %w", v, err)
+		}
+		return jsonlRecord{Key: key, Type: fmt.Sprintf("%T", v), Value: raw}, nil
+	}
+	e, err := reg.Encode(v)
+	if err != nil {
+		return jsonlRecord{}, err
+	}
+	return jsonlRecord{Key: key, Type: e.Tag, Data: e.Data, Compressed: e.Compressed}, nil
+}
+
+func decodeRecord(rec jsonlRecord, reg *CodecRegistry) (any, error) {
+	// plain JSON always has a value, even if it is only null
+	if rec.Value == nil {
+		if reg == nil {
+			return nil, fmt.Errorf("%s value needs a codec registry", rec.Type)
+		}
+		return reg.Decode(Encoded{Tag: rec.Type, Compressed: rec.Compressed, Data: rec.Data})
+	}
+	var val any
+	if err := json.Unmarshal(rec.Value, &val); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", rec.Type, err)
+	}
+	return val, nil
+}
+
+// ExportJSONL writes every live key to w. reg may be nil, in which case values
+// are written as plain JSON and come back as generic JSON types.
+func ExportJSONL(s Store, w io.Writer, reg *CodecRegistry) (int, []KeyError, error) {
+	var failed []KeyError
+	n := 0
+	enc := json.NewEncoder(w)
+	for _, it := range s.Items() {
+		rec, err := encodeRecord(it.Key, it.Value, reg)
+		if err != nil {
+			failed = append(failed, KeyError{Key: it.Key, Err: err})
+			continue
+		}
+		if it.TTL > 0 {
+			rec.TTLMillis = max(it.TTL.Milliseconds(), 1)
+		}
+		if err := enc.Encode(rec); err != nil {
+			return n, failed, err
+		}
+		n++
+	}
+	return n, failed, nil
+}
+
+func ImportJSONL(s Store, r io.Reader, reg *CodecRegistry) (int, []KeyError, error) {
+	var failed []KeyError
+	n := 0
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; sc.Scan(); line++ {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		var rec jsonlRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			failed = append(failed, KeyError{Key: fmt.Sprintf("line %d", line), Err: err})
+			continue
+		}
+		val, err := decodeRecord(rec, reg)
+		if err != nil {
+			failed = append(failed, KeyError{Key: rec.Key, Err: err})
+			continue
+		}
+		ttl := time.Duration(rec.TTLMillis) * time.Millisecond
+		if err := s.Put(rec.Key, val, ttl); err != nil {
+			failed = append(failed, KeyError{Key: rec.Key, Err: err})
+			continue
+		}
+		n++
+	}
+	return n, failed, sc.Err()
+}
+
+// kvShell is the kvctl REPL. Values given to SET are parsed as JSON when they
+// are valid JSON and kept as plain strings otherwise.
+type kvShell struct {
+	store   Store
+	codecs  *CodecRegistry
+	out     io.Writer
+	history []string
+}
+
+const kvShellHelp = `commands:
+  GET <key>
+  SET <key> <value...> [EX <duration>]
+  DEL <key>
+  TTL <key>
+  KEYS [prefix]
+  STATS
+  DUMP <file>        write live keys as JSON Lines
+  LOAD <file>        import a JSON Lines dump
+  HISTORY            list previous commands; !<n> re-runs one
+  HELP | QUIT`
+
+func newKVShell(store Store, out io.Writer) *kvShell {
+	return &kvShell{store: store, codecs: DefaultCodecRegistry(WithCompression(1024)), out: out}
+}
+
+func (sh *kvShell) run(in io.Reader, prompt bool) {
+	sc := bufio.NewScanner(in)
+	for {
+		if prompt {
+			fmt.Fprint(sh.out, "kv> ")
+		}
+		if !sc.Scan() {
+			return
+		}
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		if err := sh.exec(line); err != nil {
+			if errors.Is(err, io.EOF) {
+				return
+			}
+			fmt.Fprintln(sh.out, "(error)", err)
+		}
+	}
+}
+
+func (sh *kvShell) exec(line string) error {
+	if strings.HasPrefix(line, "!") {
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 1 || n > len(sh.history) {
+			return fmt.Errorf("no history entry %s", line)
+		}
+		line = sh.history[n-1]
+		fmt.Fprintln(sh.out, line)
+	}
+	sh.history = append(sh.history, line)
+
+	args := strings.Fields(line)
+	need := func(n int) error {
+		if len(args) < n {
+			return fmt.Errorf("%s needs %d argument(s)", strings.ToUpper(args[0]), n-1)
+		}
+		return nil
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "GET":
+		if err := need(2); err != nil {
+			return err
+		}
+		v, err := sh.store.Get(args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(sh.out, "%v (%T)\n", v, v)
+	case "SET":
+		if err := need(3); err != nil {
+			return err
+		}
+		var ttl time.Duration
+		vals := args[2:]
+		if n := len(vals); n >= 3 && strings.EqualFold(vals[n-2], "EX") {
+			d, err := time.ParseDuration(vals[n-1])
+			if err != nil {
+				return err
+			}
+			ttl, vals = d, vals[:n-2]
+		}
+		raw := strings.Join(vals, " ")
+		var val any = raw
+		if json.Valid([]byte(raw)) {
+			_ = json.Unmarshal([]byte(raw), &val)
+		}
+		if err := sh.store.Put(args[1], val, ttl); err != nil {
+			return err
+		}
+		fmt.Fprintln(sh.out, "OK")
+	case "DEL":
+		if err := need(2); err != nil {
+			return err
+		}
+		if err := sh.store.Delete(args[1]); err != nil {
+			return err
+		}
+		fmt.Fprintln(sh.out, "OK")
+	case "TTL":
+		if err := need(2); err != nil {
+			return err
+		}
+		ttl, err := sh.store.TTL(args[1])
+		if err != nil {
+			return err
+		}
+		if ttl == 0 {
+			fmt.Fprintln(sh.out, "no expiry")
+		} else {
+			fmt.Fprintln(sh.out, ttl.Round(time.Millisecond))
+		}
+	case "KEYS":
+		prefix := ""
+		if len(args) > 1 {
+			prefix = args[1]
+		}
+		for _, it := range sh.store.Items() {
+			if strings.HasPrefix(it.Key, prefix) {
+				fmt.Fprintln(sh.out, it.Key)
+			}
+		}
+	case "STATS":
+		st := sh.store.Stats()
+		fmt.Fprintf(sh.out, "keys=%d hits=%d misses=%d evictions=%d expirations=%d\n",
+			st.Keys, st.Hits, st.Misses, st.Evictions, st.Expirations)
+	case "DUMP":
+		if err := need(2); err != nil {
+			return err
+		}
+		f, err := os.Create(args[1])
+		if err != nil {
+			return err
+		}
+		n, failed, err := ExportJSONL(sh.store, f, sh.codecs)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		sh.report("exported", n, failed)
+		return err
+	case "LOAD":
+		if err := need(2); err != nil {
+			return err
+		}
+		f, err := os.Open(args[1])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		n, failed, err := ImportJSONL(sh.store, f, sh.codecs)
+		sh.report("imported", n, failed)
+		return err
+	case "HISTORY":
+		for i, h := range sh.history[:len(sh.history)-1] {
+			fmt.Fprintf(sh.out, "%4d  %s\n", i+1, h)
+		}
+	case "HELP":
+		fmt.Fprintln(sh.out, kvShellHelp)
+	case "QUIT", "EXIT":
+		return io.EOF
+	default:
+		return fmt.Errorf("unknown command %q (try HELP)", args[0])
+	}
+	return nil
+}
+
+func (sh *kvShell) report(verb string, n int, failed []KeyError) {
+	fmt.Fprintf(sh.out, "%s %d key(s)\n", verb, n)
+	for _, f := range failed {
+		fmt.Fprintln(sh.out, "  skipped", f)
+	}
+}
+
+// runKVCtl opens a store in-process and drops into the REPL:
+//
+//	go run 04-in-memory-db.go kvctl -cap 1000 -load dump.jsonl
+func runKVCtl(args []string) error {
+	fs := flag.NewFlagSet("kvctl", flag.ContinueOnError)
+	capacity := fs.Int("cap", 1024, "store capacity")
+	load := fs.String("load", "", "JSON Lines dump to import on start")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	store, err := NewInMemoryStore(*capacity, NewLRUPolicy(*capacity))
+	if err != nil {
+		return err
+	}
+	sh := newKVShell(store, os.Stdout)
+	if *load != "" {
+		if err := sh.exec("LOAD " + *load); err != nil {
+			return err
+		}
+	}
+	sh.run(os.Stdin, true)
+	return nil
+}
+
 func main() {
-	// Create store with capacity 2 & LRU eviction strategy
-	store, err := NewInMemoryStore(2, NewLRUPolicy(2))
+	if len(os.Args) > 1 {
+		var err error
+		switch os.Args[1] {
+		case "lockd":
+			if len(os.Args) != 3 {
+				err = errors.New("usage: lockd <addr>")
+			} else {
+				err = runLockDaemon(os.Args[2])
+			}
+		case "kvctl":
+			err = runKVCtl(os.Args[2:])
+		default:
+			err = fmt.Errorf("unknown command %q (want lockd or kvctl)", os.Args[1])
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Create store with capacity 2 & LRU eviction strategy on a manual clock
+	clock := NewManualClock(time.Now())
+	store, err := NewInMemoryStore(2, NewLRUPolicy(2), WithClock(clock))
 	if err != nil {
 		panic(err)
 	}
@@ -189,9 +1678,119 @@ func main() {
 
 	fmt.Println(">>> TTL demo (2 s)")
 	_ = store.Put("temp", "⏰", 2*time.Second)
-	time.Sleep(3 * time.Second)
+	clock.Advance(3 * time.Second)
 	_, err = store.Get("temp")
 	fmt.Println("temp exists after 3s?", err == nil) // false
 
 	fmt.Println(">>> Final size:", store.Size()) // should be 2 ("A" and "C")
+
+	fmt.Println(">>> Context-aware reads through a slow loader")
+	var loaderCalls int
+	var loaderMu sync.Mutex
+	slow, _ := NewInMemoryStore(8, NewLRUPolicy(8), WithLoader(func(ctx context.Context, key string) (any, time.Duration, error) {
+		loaderMu.Lock()
+		loaderCalls++
+		loaderMu.Unlock()
+		time.Sleep(150 * time.Millisecond)
+		return "loaded:" + key, 0, nil
+	}))
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	_, err = slow.GetCtx(ctx, "profile")
+	cancel()
+	fmt.Println("impatient GetCtx deadline exceeded?", errors.Is(err, context.DeadlineExceeded)) // true
+	var wg sync.WaitGroup
+	for range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = slow.Get("profile")
+		}()
+	}
+	wg.Wait()
+	v, _ = slow.Get("profile")
+	fmt.Println("profile =", v, "loader calls:", loaderCalls) // loaded:profile 1
+	cancelled, stop := context.WithCancel(context.Background())
+	stop()
+	fmt.Println("PutCtx on cancelled ctx?", slow.PutCtx(cancelled, "k", 1, 0)) // context canceled
+
+	fmt.Println(">>> Locks: fencing, safe release, blocking acquire")
+	locks := newLockService()
+	l1, _ := locks.TryAcquire("report", time.Second)
+	_, err = locks.TryAcquire("report", time.Second)
+	fmt.Println("second TryAcquire held?", errors.Is(err, ErrLockHeld)) // true
+	err = locks.Release(Lease{Name: "report", Owner: "intruder", Fence: l1.Fence})
+	fmt.Println("stranger release rejected?", errors.Is(err, ErrNotLockOwner)) // true
+
+	got := make(chan Lease)
+	go func() {
+		l, _ := locks.Acquire(context.Background(), "report", time.Second)
+		got <- l
+	}()
+	time.Sleep(50 * time.Millisecond)
+	_ = locks.Release(l1)
+	l2 := <-got
+	fmt.Println("waiter fence > holder fence?", l2.Fence > l1.Fence) // true
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	_, err = locks.Acquire(ctx, "report", time.Second)
+	cancel()
+	fmt.Println("acquire timed out?", errors.Is(err, context.DeadlineExceeded)) // true
+
+	leaseStore, _ := NewInMemoryStore(16, NewLRUPolicy(16), WithClock(clock))
+	fakeLocks, _ := NewLockService(leaseStore)
+	lf, _ := fakeLocks.TryAcquire("cron", time.Minute)
+	clock.Advance(time.Minute)
+	lg, err := fakeLocks.TryAcquire("cron", time.Minute)
+	fmt.Println("lease lapsed after 1m of fake time?", err == nil, lg.Fence > lf.Fence) // true true
+
+	fmt.Println(">>> Locks over TCP")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	defer ln.Close()
+	go NewLockServer(newLockService()).Serve(ln)
+
+	alice, _ := DialLockServer(ln.Addr().String())
+	bob, _ := DialLockServer(ln.Addr().String())
+	defer alice.Close()
+	defer bob.Close()
+	la, _ := alice.Acquire("deploy", 200*time.Millisecond, 0)
+	_, err = bob.Acquire("deploy", time.Second, 0)
+	fmt.Println("bob blocked while alice holds?", errors.Is(err, ErrLockHeld)) // true
+	lb, err := bob.Acquire("deploy", time.Second, time.Second)                 // alice's lease lapses
+	fmt.Println("bob got it after expiry?", err == nil, lb.Fence > la.Fence)   // true true
+	_, err = alice.Renew(la, time.Second)
+	fmt.Println("alice stale renew rejected?", errors.Is(err, ErrNotLockOwner)) // true
+	_ = bob.Release(lb)
+
+	fmt.Println(">>> Export / import with remaining TTLs")
+	src, _ := NewInMemoryStore(8, NewLRUPolicy(8), WithClock(clock))
+	_ = src.Put("user:1", map[string]any{"name": "ann", "age": 31}, 0)
+	_ = src.Put("session", "abc123", time.Minute)
+	_ = src.Put("callback", func() {}, 0) // not JSON-encodable
+	clock.Advance(20 * time.Second)
+
+	var dump bytes.Buffer
+	n, failed, _ := ExportJSONL(src, &dump, nil)
+	fmt.Println("exported", n, "skipped", failed) // 2, callback
+	dst, _ := NewInMemoryStore(8, NewLRUPolicy(8), WithClock(clock))
+	n, _, _ = ImportJSONL(dst, &dump, nil)
+	ttl, _ := dst.TTL("session")
+	fmt.Println("imported", n, "session ttl", ttl) // 2 40s
+
+	fmt.Println(">>> Typed values through the codec registry")
+	type point struct{ X, Y int }
+	codecs := DefaultCodecRegistry(WithCompression(64))
+	_ = codecs.Register("point", point{}, GobCodec{})
+	for _, v := range []any{point{3, 4}, strings.Repeat("z", 500), time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)} {
+		blob, _ := codecs.Marshal(v)
+		back, err := codecs.Unmarshal(blob)
+		fmt.Printf("%T round trip ok? %v (%d bytes)\n", v, err == nil && reflect.DeepEqual(back, v), len(blob))
+	}
+	_, err = codecs.Marshal(make(chan int))
+	fmt.Println("unregistered type rejected?", errors.Is(err, ErrUnregisteredType)) // true
+
+	fmt.Println(">>> kvctl session")
+	newKVShell(dst, os.Stdout).run(strings.NewReader("SET greeting hello world EX 5s\nGET greeting\nKEYS\nHISTORY\n!2\nSTATS\n"), false)
 }
@@ -1,23 +1,136 @@
 package main
 
 import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
+	"io"
+	"maps"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path"
 	"regexp"
+	"runtime"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
+	"unicode/utf8"
 )
 
-var cellRefRe = regexp.MustCompile(`^[A-Z]+[0-9]+$`)
+// cellRefRe matches a cell reference, where a $ before the column or the
+// row marks that coordinate absolute. Cells are stored without the $.
+var cellRefRe = regexp.MustCompile(`^\$?[A-Z]+\$?[0-9]+$`)
 
 func cellName(row, col int) string {
+	return fmt.Sprintf("%s%d", colName(col), row)
+}
+
+func colName(col int) string {
 	name := ""
 	for col > 0 {
 		col--
-		name = string('A'+(col%26)) + name
+		name = string(rune('A'+col%26)) + name
 		col /= 26
 	}
-	return fmt.Sprintf("%s%d", name, row)
+	return name
+}
+
+// normRef upper-cases ref and drops its $ markers, giving the key the cell
+// is stored under; false if ref is not a cell reference.
+func normRef(ref string) (string, bool) {
+	ref = strings.ToUpper(strings.TrimSpace(ref))
+	if !cellRefRe.MatchString(ref) {
+		return ref, false
+	}
+	return strings.ReplaceAll(ref, "$", ""), true
+}
+
+// splitRef is the inverse of cellName for a ref already matching cellRefRe.
+func splitRef(ref string) (row, col int) {
+	ref = strings.ReplaceAll(ref, "$", "")
+	i := 0
+	for ; i < len(ref) && ref[i] >= 'A' && ref[i] <= 'Z'; i++ {
+		col = col*26 + int(ref[i]-'A') + 1
+	}
+	row, _ = strconv.Atoi(ref[i:])
+	return row, col
+}
+
+// cellRange is an inclusive rectangle with r1 <= r2 and c1 <= c2.
+type cellRange struct {
+	r1, c1, r2, c2 int
+}
+
+func newRange(from, to string) cellRange {
+	r1, c1 := splitRef(from)
+	r2, c2 := splitRef(to)
+	return cellRange{min(r1, r2), min(c1, c2), max(r1, r2), max(c1, c2)}
+}
+
+func (g cellRange) contains(row, col int) bool {
+	return row >= g.r1 && row <= g.r2 && col >= g.c1 && col <= g.c2
+}
+
+func (g cellRange) area() int { return (g.r2 - g.r1 + 1) * (g.c2 - g.c1 + 1) }
+
+func (g cellRange) String() string { return cellName(g.r1, g.c1) + ":" + cellName(g.r2, g.c2) }
+
+// parseRange accepts "B2" or "A1:C10" in any case.
+func parseRange(s string) (cellRange, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	from, to, isRange := strings.Cut(s, ":")
+	if !isRange {
+		to = from
+	}
+	if !cellRefRe.MatchString(from) || !cellRefRe.MatchString(to) {
+		return cellRange{}, fmt.Errorf("invalid range: %s", s)
+	}
+	return newRange(from, to), nil
+}
+
+// CellError is a spreadsheet error value. It is a distinct type so a formula
+// result of #DIV/0! can never be confused with a cell holding that text.
+type CellError string
+
+const (
+	ErrRef      CellError = "#REF!"
+	ErrValue    CellError = "#VALUE!"
+	ErrName     CellError = "#NAME?"
+	ErrDiv0     CellError = "#DIV/0!"
+	ErrNA       CellError = "#N/A"
+	ErrNum      CellError = "#NUM!"
+	ErrCircular CellError = "#CIRCULAR!"
+)
+
+var cellErrors = []CellError{ErrRef, ErrValue, ErrName, ErrDiv0, ErrNA, ErrNum, ErrCircular}
+
+func (e CellError) Error() string { return string(e) }
+
+// cellKey names a cell across the sheets of a workbook.
+type cellKey struct {
+	sh  *Sheet
+	ref string
+}
+
+func (k cellKey) cell() *cell { return k.sh.grid[k.ref] }
+
+// sheetRange is a range operand resolved to the sheet it reads.
+type sheetRange struct {
+	sh *Sheet
+	g  cellRange
 }
 
 type cell struct {
@@ -25,84 +138,537 @@ type cell struct {
 	val   any
 	dirty bool
 
-	deps       map[string]struct{}
-	dependents map[string]struct{}
+	ast      expr  // parsed formula, nil for literals
+	parseErr error // set instead of ast when the formula does not parse
+
+	format string // number format set with SetFormat, "" for General
+	auto   string // format implied by the input, such as a typed date
+
+	deps       map[cellKey]struct{}
+	dependents map[cellKey]struct{}
+	ranges     []sheetRange // range operands, kept whole rather than expanded into deps
 }
 
 func newCell() *cell {
 	return &cell{
-		deps:       map[string]struct{}{},
-		dependents: map[string]struct{}{},
+		deps:       map[cellKey]struct{}{},
+		dependents: map[cellKey]struct{}{},
+	}
+}
+
+// Workbook is an ordered set of named sheets whose formulas can read each
+// other, as in =Budget!B3 or =SUM('Q1 Data'!A1:A10). The sheets share one
+// lock and one dependency graph, so a Set on one sheet has updated the
+// formulas on every other sheet by the time it returns.
+type Workbook struct {
+	mu     sync.RWMutex
+	sheets []*Sheet
+
+	// pending collects the cells markDirty flagged since the last recalc.
+	pending map[cellKey]struct{}
+
+	hist history
+	rec  *batch // edits of the operation in progress, nil when not tracked
+
+	subs []*subscription
+	old  map[cellKey]any // values before the edit in progress, for subs
+
+	// volatile holds the formulas that call TODAY, recomputed on every
+	// recalc that has anything else to do.
+	volatile map[cellKey]struct{}
+
+	calc CalcOptions
+}
+
+func NewWorkbook() *Workbook {
+	return &Workbook{
+		pending:  make(map[cellKey]struct{}),
+		volatile: make(map[cellKey]struct{}),
+		hist:     history{limit: historyLimit},
 	}
 }
 
 type Sheet struct {
-	mu   sync.RWMutex
-	grid map[string]*cell
+	wb      *Workbook
+	name    string
+	deleted bool
+	grid    map[string]*cell
+
+	// rangeUsers holds the cells, on this sheet or another, whose formulas
+	// read a range of this sheet; markDirty checks their ranges for
+	// containment instead of keeping per-cell edges.
+	rangeUsers map[cellKey]struct{}
+
+	// names maps each defined name to its definition, kept in a cell that
+	// is not part of the grid.
+	names map[string]*cell
 }
 
+// NewSheet returns a standalone sheet. It has no name and no siblings, so
+// sheet-qualified references in its formulas evaluate to #REF!.
 func NewSheet() *Sheet {
-	return &Sheet{grid: make(map[string]*cell)}
+	return NewWorkbook().newSheet("")
+}
+
+func (wb *Workbook) newSheet(name string) *Sheet {
+	sh := &Sheet{
+		wb:         wb,
+		name:       name,
+		grid:       make(map[string]*cell),
+		rangeUsers: make(map[cellKey]struct{}),
+		names:      make(map[string]*cell),
+	}
+	wb.sheets = append(wb.sheets, sh)
+	return sh
+}
+
+// AddSheet appends an empty sheet. Formulas that already mention name, and
+// so far evaluated to #REF!, start reading it.
+func (wb *Workbook) AddSheet(name string) (*Sheet, error) {
+	name = strings.TrimSpace(name)
+	if err := validSheetName(name); err != nil {
+		return nil, err
+	}
+
+	wb.mu.Lock()
+	defer wb.unlock()
+
+	if wb.lookup(name) != nil {
+		return nil, fmt.Errorf("sheet %q already exists", name)
+	}
+	sh := wb.newSheet(name)
+	wb.relink()
+	wb.recalc()
+	return sh, nil
+}
+
+// Sheet finds a sheet by name, ignoring case; nil if there is none.
+func (wb *Workbook) Sheet(name string) *Sheet {
+	wb.mu.RLock()
+	defer wb.mu.RUnlock()
+	return wb.lookup(strings.TrimSpace(name))
+}
+
+// Sheets returns the sheets in workbook order.
+func (wb *Workbook) Sheets() []*Sheet {
+	wb.mu.RLock()
+	defer wb.mu.RUnlock()
+	return append([]*Sheet(nil), wb.sheets...)
+}
+
+// RenameSheet renames a sheet and rewrites every formula in the workbook
+// that refers to it by its old name. Like DeleteSheet it clears the undo
+// history, whose recorded formulas use the old names.
+func (wb *Workbook) RenameSheet(old, name string) error {
+	name = strings.TrimSpace(name)
+	if err := validSheetName(name); err != nil {
+		return err
+	}
+
+	wb.mu.Lock()
+	defer wb.unlock()
+
+	sh := wb.lookup(strings.TrimSpace(old))
+	if sh == nil {
+		return fmt.Errorf("no sheet %q", old)
+	}
+	if other := wb.lookup(name); other != nil && other != sh {
+		return fmt.Errorf("sheet %q already exists", name)
+	}
+	oldName := sh.name
+	sh.name = name
+	rewritten := wb.rewriteRefs(func(_ *Sheet, e expr) (expr, bool) {
+		switch e := e.(type) {
+		case refExpr:
+			if e.sheet != "" && strings.EqualFold(e.sheet, oldName) {
+				e.sheet = name
+				return e, true
+			}
+		case rangeExpr:
+			if e.sheet != "" && strings.EqualFold(e.sheet, oldName) {
+				e.sheet = name
+				return e, true
+			}
+		}
+		return e, false
+	})
+	wb.relink()
+	// formulas that mention the new name, so far #REF!, may now close a
+	// cycle through this sheet
+	if err := wb.closedCycle(); err != nil {
+		sh.name = oldName
+		for c, raw := range rewritten {
+			c.raw = raw
+			c.parse()
+		}
+		wb.relink()
+		wb.recalc()
+		return err
+	}
+	wb.hist.clear()
+	wb.recalc()
+	return nil
+}
+
+// DeleteSheet removes a sheet. Every reference to it in the remaining
+// formulas is replaced by #REF!, and the removed Sheet rejects further
+// edits.
+func (wb *Workbook) DeleteSheet(name string) error {
+	wb.mu.Lock()
+	defer wb.unlock()
+
+	sh := wb.lookup(strings.TrimSpace(name))
+	if sh == nil {
+		return fmt.Errorf("no sheet %q", name)
+	}
+	wb.sheets = slices.DeleteFunc(wb.sheets, func(s *Sheet) bool { return s == sh })
+	sh.deleted = true
+	wb.hist.clear()
+	wb.subs = slices.DeleteFunc(wb.subs, func(s *subscription) bool { return s.sh == sh })
+	wb.rewriteRefs(func(_ *Sheet, e expr) (expr, bool) {
+		switch e := e.(type) {
+		case refExpr:
+			if e.sheet != "" && strings.EqualFold(e.sheet, sh.name) {
+				return errorLit(ErrRef), true
+			}
+		case rangeExpr:
+			if e.sheet != "" && strings.EqualFold(e.sheet, sh.name) {
+				return errorLit(ErrRef), true
+			}
+		}
+		return e, false
+	})
+	wb.relink()
+	wb.recalc()
+	return nil
+}
+
+// Recalculate re-evaluates every formula of every sheet from scratch.
+func (wb *Workbook) Recalculate() {
+	wb.mu.Lock()
+	defer wb.unlock()
+	wb.markAllFormulas()
+	wb.recalc()
+}
+
+// lookup finds a sheet by name; unnamed standalone sheets never match.
+func (wb *Workbook) lookup(name string) *Sheet {
+	for _, sh := range wb.sheets {
+		if sh.name != "" && strings.EqualFold(sh.name, name) {
+			return sh
+		}
+	}
+	return nil
+}
+
+// rewriteRefs passes every reference and range of every formula and name
+// definition through fn, along with the sheet holding it, and regenerates
+// the text of the formulas it changed. It returns their previous text.
+func (wb *Workbook) rewriteRefs(fn func(owner *Sheet, e expr) (expr, bool)) map[*cell]string {
+	before := make(map[*cell]string)
+	for _, sh := range wb.sheets {
+		rewrite := func(c *cell) {
+			if c.ast == nil {
+				return
+			}
+			ast, changed := mapRefs(c.ast, func(e expr) (expr, bool) { return fn(sh, e) })
+			if changed {
+				before[c] = c.raw
+				c.ast = ast
+				c.raw = "=" + formatExpr(ast)
+			}
+		}
+		for _, c := range sh.grid {
+			rewrite(c)
+		}
+		for _, c := range sh.names {
+			rewrite(c)
+		}
+	}
+	return before
+}
+
+// relink rebuilds the dependency graph from the parsed formulas, for when
+// sheets come, go or change names, and queues every formula for recalc.
+func (wb *Workbook) relink() {
+	clear(wb.volatile)
+	for _, sh := range wb.sheets {
+		clear(sh.rangeUsers)
+		for _, c := range sh.grid {
+			clear(c.deps)
+			clear(c.dependents)
+			c.ranges = nil
+		}
+	}
+	for _, sh := range wb.sheets {
+		for ref, c := range sh.grid {
+			if c.ast != nil {
+				sh.link(ref, c)
+			}
+		}
+	}
+	wb.markAllFormulas()
+}
+
+func (wb *Workbook) markAllFormulas() {
+	for _, sh := range wb.sheets {
+		for ref, c := range sh.grid {
+			if c.ast != nil || c.parseErr != nil {
+				c.dirty = true
+				wb.pending[cellKey{sh, ref}] = struct{}{}
+			}
+		}
+	}
+}
+
+// Name is the sheet's name in its workbook, "" for a standalone sheet.
+func (sh *Sheet) Name() string {
+	sh.wb.mu.RLock()
+	defer sh.wb.mu.RUnlock()
+	return sh.name
 }
 
 func (sh *Sheet) Set(ref, raw string) error {
-	ref = strings.ToUpper(strings.TrimSpace(ref))
-	if !cellRefRe.MatchString(ref) {
+	ref, ok := normRef(ref)
+	if !ok {
 		return fmt.Errorf("invalid ref: %s", ref)
 	}
 
-	sh.mu.Lock()
-	defer sh.mu.Unlock()
+	sh.wb.mu.Lock()
+	defer sh.wb.unlock()
 
+	if sh.deleted {
+		return fmt.Errorf("sheet %q was deleted", sh.name)
+	}
+	if sh.wb.calc.Strict {
+		if path := sh.cyclePath(ref, raw); path != nil {
+			return &CycleError{sh.keyNames(path)}
+		}
+	}
+	defer sh.wb.track()()
+	sh.assign(ref, raw)
+	sh.wb.recalc()
+
+	return nil
+}
+
+// assign stores raw in ref, rewires the dependency graph and marks what
+// needs recomputing. Callers hold the write lock and run recalc once they
+// are done, so bulk edits pay for a single recalculation.
+func (sh *Sheet) assign(ref, raw string) {
 	c := sh.ensure(ref)
+	sh.unlink(ref, c)
 
-	for d := range c.deps {
-		delete(sh.grid[d].dependents, ref)
+	raw = strings.TrimSpace(raw)
+	if sh.wb.rec != nil && raw != c.raw {
+		sh.wb.rec.add(cellEdit{sh, ref, c.raw, raw})
+	}
+	c.raw = raw
+	c.dirty = false // let markDirty reach the dependents
+
+	c.parse()
+	if c.ast != nil {
+		sh.link(ref, c)
+	}
+
+	sh.markDirty(ref)
+}
+
+// parse sets ast or parseErr from raw, and the format the input implies:
+// a typed date shows as typed, and a formula whose outermost call is DATE
+// or TODAY shows as a date.
+func (c *cell) parse() {
+	c.ast, c.parseErr, c.auto = nil, nil, ""
+	if !strings.HasPrefix(c.raw, "=") {
+		_, c.auto, _ = parseDateLiteral(c.raw)
+		return
 	}
-	c.deps = map[string]struct{}{}
+	c.ast, c.parseErr = parseFormula(c.raw[1:])
+	if call, ok := c.ast.(*callExpr); ok && (call.name == "DATE" || call.name == "TODAY") {
+		c.auto = "yyyy-mm-dd"
+	}
+}
 
-	c.raw = strings.TrimSpace(raw)
-	c.dirty = true
+// link adds the references of c's formula to the graph, looking through
+// defined names to the cells they stand for. References to sheets that do
+// not exist are left out: they evaluate to #REF!, and relink wires them up
+// if such a sheet is added later, as it does for names defined later.
+func (sh *Sheet) link(ref string, c *cell) {
+	self := cellKey{sh, ref}
+	if sh.volatileIn(c.ast) {
+		sh.wb.volatile[self] = struct{}{}
+	}
+	sh.operands(c.ast, func(k cellKey) {
+		c.deps[k] = struct{}{}
+		k.sh.ensure(k.ref).dependents[self] = struct{}{}
+	}, func(r sheetRange) {
+		c.ranges = append(c.ranges, r)
+		r.sh.rangeUsers[self] = struct{}{}
+	})
+}
 
-	if strings.HasPrefix(c.raw, "=") {
-		for _, tok := range tokenScan(c.raw[1:]) {
-			if cellRefRe.MatchString(tok) {
-				c.deps[tok] = struct{}{}
-				sh.ensure(tok).dependents[ref] = struct{}{}
+// operands calls ref for every cell and rng for every range that e reads,
+// looking through defined names, and skips sheets that do not exist.
+func (sh *Sheet) operands(e expr, ref func(cellKey), rng func(sheetRange)) {
+	var visit func(e expr)
+	visit = func(e expr) {
+		switch e := e.(type) {
+		case refExpr:
+			if target := sh.resolve(e.sheet); target != nil {
+				ref(cellKey{target, e.ref})
+			}
+		case rangeExpr:
+			if target := sh.resolve(e.sheet); target != nil {
+				rng(sheetRange{target, e.g})
+			}
+		case nameExpr:
+			if def, ok := sh.names[string(e)]; ok {
+				collectRefs(def.ast, visit)
 			}
 		}
 	}
+	collectRefs(e, visit)
+}
 
-	sh.markDirty(ref)
+func (sh *Sheet) unlink(ref string, c *cell) {
+	self := cellKey{sh, ref}
+	delete(sh.wb.volatile, self)
+	for d := range c.deps {
+		delete(d.cell().dependents, self)
+	}
+	clear(c.deps)
+	for _, r := range c.ranges {
+		delete(r.sh.rangeUsers, self)
+	}
+	c.ranges = nil
+}
 
-	return nil
+// volatileIn reports whether e calls a volatile function, directly or
+// through the defined names it uses.
+func (sh *Sheet) volatileIn(e expr) bool {
+	switch e := e.(type) {
+	case *callExpr:
+		if volatileFuncs[e.name] {
+			return true
+		}
+		for _, a := range e.args {
+			if sh.volatileIn(a) {
+				return true
+			}
+		}
+	case *unaryExpr:
+		return sh.volatileIn(e.x)
+	case *binaryExpr:
+		return sh.volatileIn(e.l) || sh.volatileIn(e.r)
+	case nameExpr:
+		if def, ok := sh.names[string(e)]; ok {
+			return sh.volatileIn(def.ast)
+		}
+	}
+	return false
+}
+
+// resolve maps the sheet part of a reference to a sheet: "" is the sheet
+// itself, anything else a sibling in the workbook or nil.
+func (sh *Sheet) resolve(name string) *Sheet {
+	if name == "" {
+		return sh
+	}
+	return sh.wb.lookup(name)
 }
 
+// Get returns the evaluated value: float64, string, bool, a CellError, or ""
+// for a blank cell. The error is reserved for formulas that do not parse.
+// Values are computed by Set, so Get only reads and readers never contend
+// with each other.
 func (sh *Sheet) Get(ref string) (any, error) {
-	sh.mu.RLock()
-	defer sh.mu.RUnlock()
+	sh.wb.mu.RLock()
+	defer sh.wb.mu.RUnlock()
 
-	ref = strings.ToUpper(strings.TrimSpace(ref))
+	ref, _ = normRef(ref)
 	c, ok := sh.grid[ref]
-	if !ok {
+	if !ok || c.val == nil {
 		return "", nil // blank cell
 	}
-	val, err := sh.eval(ref, map[string]struct{}{})
-	return val, err
+	return c.val, c.parseErr
 }
 
-func (sh *Sheet) Print() {
-	sh.mu.RLock()
-	defer sh.mu.RUnlock()
-	for r := 1; r <= 5; r++ {
-		rowVals := make([]string, 5)
-		for c := 1; c <= 5; c++ {
-			ref := cellName(r, c)
-			v, _ := sh.eval(ref, map[string]struct{}{})
-			rowVals[c-1] = fmt.Sprintf("%v", v)
+// Display returns the value of ref as the sheet shows it: numbers through
+// the cell's number format, dates as dates, and everything else as Get's
+// value in text. The error is Get's.
+func (sh *Sheet) Display(ref string) (string, error) {
+	ref, ok := normRef(ref)
+	if !ok {
+		return "", fmt.Errorf("invalid ref: %s", ref)
+	}
+
+	sh.wb.mu.RLock()
+	defer sh.wb.mu.RUnlock()
+
+	c, ok := sh.grid[ref]
+	if !ok {
+		return "", nil
+	}
+	return c.display(), c.parseErr
+}
+
+// SetFormat gives every cell of rng, a cell or range such as "B2:B9", the
+// number format pattern: "0.00", "#,##0", "0%", "$#,##0.00" or a date
+// format such as "yyyy-mm-dd" or "d mmm yyyy hh:mm". Sections split by ";"
+// apply to positive, negative and zero values. An empty pattern goes back
+// to General. Formats change how values are shown, never the values.
+func (sh *Sheet) SetFormat(rng, pattern string) error {
+	g, err := parseRange(rng)
+	if err != nil {
+		return err
+	}
+
+	sh.wb.mu.Lock()
+	defer sh.wb.unlock()
+
+	if sh.deleted {
+		return fmt.Errorf("sheet %q was deleted", sh.name)
+	}
+	defer sh.wb.track()()
+	for r := g.r1; r <= g.r2; r++ {
+		for c := g.c1; c <= g.c2; c++ {
+			sh.setFormat(cellName(r, c), pattern)
+		}
+	}
+	return nil
+}
+
+// setFormat records the change for undo; callers hold the write lock.
+func (sh *Sheet) setFormat(ref, pattern string) {
+	c, ok := sh.grid[ref]
+	if !ok && pattern == "" {
+		return
+	}
+	if !ok {
+		c = sh.ensure(ref)
+	}
+	if c.format == pattern {
+		return
+	}
+	if sh.wb.rec != nil {
+		sh.wb.rec.add(formatEdit{sh, ref, c.format, pattern})
+	}
+	c.format = pattern
+}
+
+func (c *cell) display() string {
+	if f, ok := c.val.(float64); ok {
+		if pattern := cmp.Or(c.format, c.auto); pattern != "" {
+			return formatNumber(f, pattern)
 		}
-		fmt.Println(strings.Join(rowVals, "\t"))
 	}
+	return displayText(c.val)
+}
+
+// Recalculate re-evaluates every formula from scratch, including those on
+// the other sheets of the workbook.
+func (sh *Sheet) Recalculate() {
+	sh.wb.Recalculate()
 }
 
 func (sh *Sheet) ensure(ref string) *cell {
@@ -118,127 +684,6262 @@ func (sh *Sheet) markDirty(ref string) {
 	c := sh.grid[ref]
 	if !c.dirty {
 		c.dirty = true
+		sh.wb.pending[cellKey{sh, ref}] = struct{}{}
 		for dep := range c.dependents {
-			sh.markDirty(dep)
+			dep.sh.markDirty(dep.ref)
+		}
+		row, col := splitRef(ref)
+		for user := range sh.rangeUsers {
+			for _, r := range user.cell().ranges {
+				if r.sh == sh && r.g.contains(row, col) {
+					user.sh.markDirty(user.ref)
+					break
+				}
+			}
 		}
 	}
 }
 
-func (sh *Sheet) eval(ref string, path map[string]struct{}) (any, error) {
-	c := sh.grid[ref]
-	if !c.dirty {
-		return c.val, nil
+// valueAt reads a computed value; blank and missing cells are nil.
+func (sh *Sheet) valueAt(ref string) any {
+	if c, ok := sh.grid[ref]; ok {
+		return c.val
 	}
+	return nil
+}
 
-	if _, ok := path[ref]; ok {
-		c.val = "#CYCLE!"
-		c.dirty = false
-		return c.val, fmt.Errorf("cycle at %s", ref)
+// eachInRange visits the values of the non-blank cells of g. Small ranges
+// are walked cell by cell in row-major order; ranges larger than the grid
+// scan the grid instead, so =SUM(A1:A1000000) costs no more than the cells
+// that exist.
+func (sh *Sheet) eachInRange(g cellRange, fn func(v any)) {
+	visit := func(ref string) {
+		if c, ok := sh.grid[ref]; ok && c.raw != "" {
+			fn(c.val)
+		}
 	}
-	path[ref] = struct{}{}
-
-	if !strings.HasPrefix(c.raw, "=") {
-		if f, err := strconv.ParseFloat(c.raw, 64); err == nil {
-			c.val = f
-		} else {
-			c.val = c.raw
-		}
-		c.dirty = false
-		delete(path, ref)
-		return c.val, nil
-	}
-
-	toks := tokenScan(c.raw[1:])
-	if len(toks) != 3 {
-		c.val = "#ERR!"
-		c.dirty = false
-		delete(path, ref)
-		return c.val, fmt.Errorf("bad expr %s", c.raw)
-	}
-	left, op, right := toks[0], toks[1], toks[2]
-
-	lv, err1 := sh.atom(left, path)
-	rv, err2 := sh.atom(right, path)
-	if err1 != nil || err2 != nil {
-		c.val = "#ERR!"
-	} else if lf, lok := lv.(float64); lok {
-		if rf, rok := rv.(float64); rok {
-			switch op {
-			case "+":
-				c.val = lf + rf
-			case "-":
-				c.val = lf - rf
-			case "*":
-				c.val = lf * rf
-			case "/":
-				if rf == 0 {
-					c.val = "#DIV/0!"
-				} else {
-					c.val = lf / rf
-				}
-			default:
-				c.val = "#ERR!"
+	if g.area() <= len(sh.grid) {
+		for r := g.r1; r <= g.r2; r++ {
+			for c := g.c1; c <= g.c2; c++ {
+				visit(cellName(r, c))
 			}
-		} else {
-			c.val = "#ERR!"
 		}
-	} else {
-		c.val = "#ERR!"
+		return
+	}
+	for ref := range sh.grid {
+		if g.contains(splitRef(ref)) {
+			visit(ref)
+		}
 	}
-	c.dirty = false
-	delete(path, ref)
-	return c.val, nil
 }
 
-func (sh *Sheet) atom(tok string, path map[string]struct{}) (any, error) {
-	if cellRefRe.MatchString(tok) {
-		return sh.eval(tok, path)
+// ---------- recalculation ----------
+
+// parallelWave is the wave size from which recalc fans evaluation out over
+// goroutines; smaller waves are cheaper to evaluate inline.
+const parallelWave = 64
+
+// recalc brings every pending cell up to date under the write lock, along
+// with the volatile formulas whenever there is any work to do. Cells
+// are evaluated in waves: a wave holds the cells whose precedents are all
+// up to date, so its members never read each other and a large wave is
+// evaluated in parallel. If no wave can form, the remaining cells sit on or
+// behind a cycle: each strongly connected component becomes #CIRCULAR!, or
+// is iterated to a solution in iterative mode, and the cells downstream of
+// it carry on from there.
+func (wb *Workbook) recalc() {
+	if len(wb.pending) > 0 {
+		for key := range wb.volatile {
+			key.sh.markDirty(key.ref)
+		}
 	}
-	if f, err := strconv.ParseFloat(tok, 64); err == nil {
-		return f, nil
+	dirty := wb.pending
+	wb.pending = make(map[cellKey]struct{})
+	if len(dirty) == 0 {
+		return
+	}
+	for key := range dirty {
+		wb.noteOld(key)
+	}
+
+	preds := make(map[cellKey]map[cellKey]struct{}, len(dirty))
+	succs := make(map[cellKey][]cellKey, len(dirty))
+	for key := range dirty {
+		preds[key] = precedentsIn(key, dirty)
+		for p := range preds[key] {
+			succs[p] = append(succs[p], key)
+		}
+	}
+	indeg := make(map[cellKey]int, len(dirty))
+	var wave []cellKey
+	for key := range dirty {
+		if indeg[key] = len(preds[key]); indeg[key] == 0 {
+			wave = append(wave, key)
+		}
 	}
-	return nil, fmt.Errorf("invalid token %s", tok)
-}
 
-func tokenScan(expr string) []string {
-	out := []string{}
-	cur := ""
-	for _, r := range expr {
-		if r == '+' || r == '-' || r == '*' || r == '/' {
-			if cur != "" {
-				out = append(out, strings.TrimSpace(cur))
-				cur = ""
+	finish := func(done []cellKey) (next []cellKey) {
+		for _, key := range done {
+			delete(dirty, key)
+		}
+		for _, key := range done {
+			for _, s := range succs[key] {
+				if _, open := dirty[s]; !open {
+					continue
+				}
+				if indeg[s]--; indeg[s] == 0 {
+					next = append(next, s)
+				}
 			}
-			out = append(out, string(r))
-		} else {
-			cur += string(r)
+		}
+		return next
+	}
+
+	for len(dirty) > 0 {
+		if len(wave) == 0 {
+			var cyclic []cellKey
+			for _, scc := range stronglyConnected(dirty, func(key cellKey) []cellKey { return succs[key] }) {
+				if len(scc) == 1 && !hasKey(preds[scc[0]], scc[0]) {
+					continue
+				}
+				if !wb.calc.Iterative {
+					cyclic = append(cyclic, scc...)
+					continue
+				}
+				// solve the cycles nothing pending feeds; the rest wait
+				if fedFromOutside(scc, preds, dirty) {
+					continue
+				}
+				wb.iterate(scc)
+				cyclic = append(cyclic, scc...)
+			}
+			if !wb.calc.Iterative {
+				for _, key := range cyclic {
+					c := key.cell()
+					c.val, c.dirty = ErrCircular, false
+				}
+			}
+			wave = finish(cyclic)
+			continue
+		}
+		evalWave(wave)
+		wave = finish(wave)
+	}
+}
+
+// precedentsIn returns the members of set that key's formula reads, either
+// directly or through one of its ranges.
+func precedentsIn(key cellKey, set map[cellKey]struct{}) map[cellKey]struct{} {
+	c := key.cell()
+	out := make(map[cellKey]struct{})
+	for d := range c.deps {
+		if _, ok := set[d]; ok {
+			out[d] = struct{}{}
 		}
 	}
-	if cur != "" {
-		out = append(out, strings.TrimSpace(cur))
+	if len(c.ranges) > 0 {
+		for other := range set {
+			row, col := splitRef(other.ref)
+			for _, r := range c.ranges {
+				if r.sh == other.sh && r.g.contains(row, col) {
+					out[other] = struct{}{}
+					break
+				}
+			}
+		}
 	}
 	return out
 }
 
-func main() {
-	s := NewSheet()
-	_ = s.Set("A1", "5")
-	_ = s.Set("B1", "10")
-	_ = s.Set("C1", "=A1+B1")
-	_ = s.Set("D1", "=C1*2")
-	_ = s.Set("E1", "=D1/A1")
+func evalWave(wave []cellKey) {
+	if len(wave) < parallelWave {
+		for _, key := range wave {
+			evalCell(key)
+		}
+		return
+	}
+	workers := min(runtime.GOMAXPROCS(0), len(wave)/parallelWave+1)
+	chunk := (len(wave) + workers - 1) / workers
+	var wg sync.WaitGroup
+	for lo := 0; lo < len(wave); lo += chunk {
+		part := wave[lo:min(lo+chunk, len(wave))]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, key := range part {
+				evalCell(key)
+			}
+		}()
+	}
+	wg.Wait()
+}
 
-	fmt.Println("initial sheet")
-	s.Print()
+// evalCell computes one cell from already up-to-date precedents. It only
+// writes to its own cell, which is what makes evalWave safe to parallelise.
+func evalCell(key cellKey) {
+	c := key.cell()
+	switch {
+	case c.parseErr != nil:
+		c.val = ErrValue
+	case c.ast != nil:
+		if c.val = c.ast.eval(&evalCtx{sh: key.sh}); c.val == nil {
+			c.val = 0.0 // =B9 on a blank B9 shows 0, not a blank
+		}
+	default:
+		c.val = literalValue(c.raw)
+	}
+	c.dirty = false
+}
 
-	// update A1; dependents auto-dirty
-	_ = s.Set("A1", "20")
-	fmt.Println("\nafter A1=20")
-	s.Print()
+// stronglyConnected runs Tarjan's algorithm over nodes, following edges
+// only into nodes of the same set.
+func stronglyConnected(nodes map[cellKey]struct{}, edges func(cellKey) []cellKey) [][]cellKey {
+	index := make(map[cellKey]int, len(nodes))
+	low := make(map[cellKey]int, len(nodes))
+	onStack := make(map[cellKey]bool)
+	var stack []cellKey
+	var out [][]cellKey
 
-	// introduce a cycle
+	var visit func(v cellKey)
+	visit = func(v cellKey) {
+		index[v], low[v] = len(index), len(index)
+		stack = append(stack, v)
+		onStack[v] = true
+		for _, w := range edges(v) {
+			if _, in := nodes[w]; !in {
+				continue
+			}
+			if _, seen := index[w]; !seen {
+				visit(w)
+				low[v] = min(low[v], low[w])
+			} else if onStack[w] {
+				low[v] = min(low[v], index[w])
+			}
+		}
+		if low[v] == index[v] {
+			var scc []cellKey
+			for {
+				w := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				onStack[w] = false
+				scc = append(scc, w)
+				if w == v {
+					break
+				}
+			}
+			out = append(out, scc)
+		}
+	}
+	for v := range nodes {
+		if _, seen := index[v]; !seen {
+			visit(v)
+		}
+	}
+	return out
+}
+
+func hasKey(m map[cellKey]struct{}, k cellKey) bool {
+	_, ok := m[k]
+	return ok
+}
+
+// fedFromOutside reports whether a member of scc reads a pending cell
+// outside it.
+func fedFromOutside(scc []cellKey, preds map[cellKey]map[cellKey]struct{}, pending map[cellKey]struct{}) bool {
+	for _, key := range scc {
+		for p := range preds[key] {
+			if hasKey(pending, p) && !slices.Contains(scc, p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ---------- circular references ----------
+
+// CalcOptions control what recalculation does with circular references.
+// By default every formula on a cycle shows #CIRCULAR!.
+type CalcOptions struct {
+	// Iterative solves cycles by evaluating their formulas over and over,
+	// each from the latest values of the others, as circular models such
+	// as interest on an average balance need.
+	Iterative     bool
+	MaxIterations int     // per cycle and recalculation; 0 means 100
+	MaxChange     float64 // stop once no value moves by more; 0 means 0.001
+
+	// Strict makes every edit that would close a cycle fail with a
+	// *CycleError and leave the workbook as it was. That covers Set,
+	// pastes and fills, imports and loads into a sheet, row and column
+	// edits, name definitions and sheet renames; Undo and Redo report
+	// false instead.
+	Strict bool
+}
+
+// CycleError is how an edit is refused, in strict mode, when it would make
+// a formula read itself. Path runs from a cell on the cycle, the edited
+// cell in the case of Set, through the cells each one reads and back to
+// it.
+type CycleError struct {
+	Path []string
+}
+
+func (e *CycleError) Error() string {
+	return "circular reference: " + strings.Join(e.Path, " -> ")
+}
+
+// SetCalcOptions changes how the workbook treats circular references and
+// recalculates everything accordingly. Strict mode cannot be combined with
+// iteration, and cannot be turned on while the workbook has a cycle.
+func (wb *Workbook) SetCalcOptions(o CalcOptions) error {
+	switch {
+	case o.Iterative && o.Strict:
+		return errors.New("iterative and strict calculation exclude each other")
+	case o.MaxIterations < 0 || o.MaxChange < 0:
+		return fmt.Errorf("invalid iteration limits %d and %g", o.MaxIterations, o.MaxChange)
+	}
+	o.MaxIterations = cmp.Or(o.MaxIterations, 100)
+	o.MaxChange = cmp.Or(o.MaxChange, 0.001)
+
+	wb.mu.Lock()
+	defer wb.unlock()
+
+	if o.Strict {
+		if cycles := wb.cycles(); len(cycles) > 0 {
+			return fmt.Errorf("strict calculation needs a workbook without cycles, found %s", strings.Join((*Sheet)(nil).keyNames(cycles[0]), ", "))
+		}
+	}
+	wb.calc = o
+	wb.markAllFormulas()
+	wb.recalc()
+	return nil
+}
+
+// SetCalcOptions sets the options of the sheet's workbook.
+func (sh *Sheet) SetCalcOptions(o CalcOptions) error { return sh.wb.SetCalcOptions(o) }
+
+// iterate solves one cycle: its formulas are evaluated in turn, each from
+// the values the others have at that point, starting from the values they
+// had, until an iteration moves no value by more than MaxChange or
+// MaxIterations is reached. The last values stand either way, as in
+// spreadsheets. Callers hold the write lock.
+func (wb *Workbook) iterate(scc []cellKey) {
+	wb.sortKeys(scc)
+	for _, key := range scc {
+		if c := key.cell(); c.val == ErrCircular {
+			c.val = nil // left from before iteration was on; start from blank
+		}
+	}
+	for range wb.calc.MaxIterations {
+		settled := true
+		for _, key := range scc {
+			c := key.cell()
+			before := c.val
+			evalCell(key)
+			if !withinChange(before, c.val, wb.calc.MaxChange) {
+				settled = false
+			}
+		}
+		if settled {
+			return
+		}
+	}
+}
+
+func withinChange(a, b any, tolerance float64) bool {
+	x, ok1 := a.(float64)
+	y, ok2 := b.(float64)
+	if ok1 && ok2 {
+		return math.Abs(x-y) <= tolerance
+	}
+	return a == b
+}
+
+// refuseCycle, in strict mode, undoes the edits the operation under way
+// has recorded if they closed a cycle, and returns the cycle. Callers hold
+// the write lock, track the operation and recalculate afterwards.
+func (wb *Workbook) refuseCycle() error {
+	err := wb.closedCycle()
+	if err != nil {
+		done := *wb.rec
+		wb.rec = nil // undoing records nothing
+		done.undo()
+		wb.rec = &batch{}
+	}
+	return err
+}
+
+// closedCycle reports, in strict mode, a cycle that the edit under way
+// closed; strict mode starts out without any. Callers hold the write lock
+// and have linked the edited formulas.
+func (wb *Workbook) closedCycle() error {
+	if !wb.calc.Strict {
+		return nil
+	}
+	cycles := wb.cycles()
+	if len(cycles) == 0 {
+		return nil
+	}
+	start := cycles[0][0]
+	path := start.sh.cyclePath(start.ref, start.cell().raw)
+	if path == nil {
+		path = cycles[0]
+	}
+	return &CycleError{start.sh.keyNames(path)}
+}
+
+// cyclePath returns the chain of reads by which raw, entered in ref, would
+// read itself: ref, a cell it reads, a cell that one reads and so on, back
+// to ref. It is nil when raw closes no cycle. Callers hold the lock.
+func (sh *Sheet) cyclePath(ref, raw string) []cellKey {
+	raw = strings.TrimSpace(raw)
+	if !strings.HasPrefix(raw, "=") {
+		return nil
+	}
+	ast, err := parseFormula(raw[1:])
+	if err != nil {
+		return nil
+	}
+	target := cellKey{sh, ref}
+	row, col := splitRef(ref)
+	// next lists what a formula reads, in order so the path is stable; a
+	// range over ref reads ref even while it is blank
+	next := func(deps map[cellKey]struct{}, ranges []sheetRange) []cellKey {
+		out := slices.Collect(maps.Keys(deps))
+		for _, r := range ranges {
+			if r.sh == sh && r.g.contains(row, col) {
+				out = append(out, target)
+			}
+			for member, c := range r.sh.grid {
+				if c.ast != nil && r.g.contains(splitRef(member)) {
+					out = append(out, cellKey{r.sh, member})
+				}
+			}
+		}
+		sh.wb.sortKeys(out)
+		return out
+	}
+
+	deps := make(map[cellKey]struct{})
+	var ranges []sheetRange
+	sh.operands(ast, func(k cellKey) { deps[k] = struct{}{} }, func(r sheetRange) { ranges = append(ranges, r) })
+
+	seen := make(map[cellKey]bool)
+	var path []cellKey
+	var walk func(k cellKey, reads []cellKey) bool
+	walk = func(k cellKey, reads []cellKey) bool {
+		path = append(path, k)
+		for _, n := range reads {
+			if n == target {
+				path = append(path, target)
+				return true
+			}
+			if seen[n] {
+				continue
+			}
+			seen[n] = true
+			if c := n.cell(); c != nil && c.ast != nil && walk(n, next(c.deps, c.ranges)) {
+				return true
+			}
+		}
+		path = path[:len(path)-1]
+		return false
+	}
+	if walk(target, next(deps, ranges)) {
+		return path
+	}
+	return nil
+}
+
+// ---------- auditing the dependency graph ----------
+
+// Precedents lists the cells whose values the formula in ref reads, and
+// with transitive the cells those read in turn. Cells read through a range
+// or a defined name count, blank cells of a range do not. Cells on other
+// sheets are qualified with their sheet, as in Rates!B2; the list is in
+// workbook order, row by row.
+func (sh *Sheet) Precedents(ref string, transitive bool) ([]string, error) {
+	return sh.trace(ref, transitive, precedentsOf)
+}
+
+// Dependents lists the formulas that read ref, and with transitive the
+// formulas that read those in turn: everything an edit of ref recomputes.
+// A formula on a cycle is among its own precedents and dependents.
+func (sh *Sheet) Dependents(ref string, transitive bool) ([]string, error) {
+	return sh.trace(ref, transitive, dependentsOf)
+}
+
+func (sh *Sheet) trace(ref string, transitive bool, next func(cellKey) []cellKey) ([]string, error) {
+	ref, ok := normRef(ref)
+	if !ok {
+		return nil, fmt.Errorf("invalid ref: %s", ref)
+	}
+
+	sh.wb.mu.RLock()
+	defer sh.wb.mu.RUnlock()
+
+	// ref itself is only found again if it sits on a cycle
+	seen := make(map[cellKey]struct{})
+	var found []cellKey
+	queue := []cellKey{{sh, ref}}
+	for len(queue) > 0 {
+		key := queue[0]
+		queue = queue[1:]
+		for _, n := range next(key) {
+			if hasKey(seen, n) {
+				continue
+			}
+			seen[n] = struct{}{}
+			found = append(found, n)
+			if transitive {
+				queue = append(queue, n)
+			}
+		}
+	}
+	return sh.refNames(found), nil
+}
+
+// precedentsOf returns the cells key reads, ranges expanded to their
+// non-blank cells.
+func precedentsOf(key cellKey) []cellKey {
+	c := key.cell()
+	if c == nil {
+		return nil
+	}
+	out := slices.Collect(maps.Keys(c.deps))
+	for _, r := range c.ranges {
+		for ref, cl := range r.sh.grid {
+			if cl.raw != "" && r.g.contains(splitRef(ref)) {
+				out = append(out, cellKey{r.sh, ref})
+			}
+		}
+	}
+	return out
+}
+
+// dependentsOf returns the formulas that read key, directly or through a
+// range. A blank cell nothing refers to directly may still sit in a range.
+func dependentsOf(key cellKey) []cellKey {
+	var out []cellKey
+	if c := key.cell(); c != nil {
+		out = slices.Collect(maps.Keys(c.dependents))
+	}
+	row, col := splitRef(key.ref)
+	for user := range key.sh.rangeUsers {
+		for _, r := range user.cell().ranges {
+			if r.sh == key.sh && r.g.contains(row, col) {
+				out = append(out, user)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// DetectCycles returns the groups of formulas on a cycle that have a cell
+// on this sheet, each a strongly connected component of the dependency
+// graph or a single formula that reads itself. Groups and the cells in
+// them are in workbook order, named as Precedents names cells.
+func (sh *Sheet) DetectCycles() [][]string {
+	sh.wb.mu.RLock()
+	defer sh.wb.mu.RUnlock()
+
+	var out [][]string
+	for _, scc := range sh.wb.cycles() {
+		if slices.ContainsFunc(scc, func(k cellKey) bool { return k.sh == sh }) {
+			out = append(out, sh.refNames(scc))
+		}
+	}
+	return out
+}
+
+// cycles finds the strongly connected components of the formula graph that
+// form a cycle. Callers hold the lock.
+func (wb *Workbook) cycles() [][]cellKey {
+	formulas := make(map[cellKey]struct{})
+	for _, sh := range wb.sheets {
+		for ref, c := range sh.grid {
+			if c.ast != nil {
+				formulas[cellKey{sh, ref}] = struct{}{}
+			}
+		}
+	}
+	preds := make(map[cellKey]map[cellKey]struct{}, len(formulas))
+	succs := make(map[cellKey][]cellKey, len(formulas))
+	for key := range formulas {
+		preds[key] = precedentsIn(key, formulas)
+		for p := range preds[key] {
+			succs[p] = append(succs[p], key)
+		}
+	}
+	var out [][]cellKey
+	for _, scc := range stronglyConnected(formulas, func(key cellKey) []cellKey { return succs[key] }) {
+		if len(scc) > 1 || hasKey(preds[scc[0]], scc[0]) {
+			wb.sortKeys(scc)
+			out = append(out, scc)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return wb.keyLess(out[i][0], out[j][0]) })
+	return out
+}
+
+// refNames sorts keys and names them relative to sh.
+func (sh *Sheet) refNames(keys []cellKey) []string {
+	sh.wb.sortKeys(keys)
+	return sh.keyNames(keys)
+}
+
+// keyNames names keys relative to sh, or with their sheet names for a nil
+// sh.
+func (sh *Sheet) keyNames(keys []cellKey) []string {
+	out := make([]string, len(keys))
+	for i, k := range keys {
+		out[i] = k.ref
+		if k.sh != sh {
+			out[i] = sheetPrefix(k.sh.name) + k.ref
+		}
+	}
+	return out
+}
+
+func (wb *Workbook) sortKeys(keys []cellKey) {
+	sort.Slice(keys, func(i, j int) bool { return wb.keyLess(keys[i], keys[j]) })
+}
+
+// keyLess orders cells by sheet, then row by row.
+func (wb *Workbook) keyLess(a, b cellKey) bool {
+	if a.sh != b.sh {
+		return slices.Index(wb.sheets, a.sh) < slices.Index(wb.sheets, b.sh)
+	}
+	ra, ca := splitRef(a.ref)
+	rb, cb := splitRef(b.ref)
+	return ra < rb || ra == rb && ca < cb
+}
+
+// WriteDOT writes the dependency graph of the sheet's formulas as a
+// Graphviz digraph, for `dot -Tsvg`. Edges run from what is read to the
+// formula reading it; ranges are box nodes fed by their non-blank cells,
+// cells on other sheets are drawn with their sheet name, and formulas on a
+// cycle are filled red.
+func (sh *Sheet) WriteDOT(w io.Writer) error {
+	sh.wb.mu.RLock()
+	defer sh.wb.mu.RUnlock()
+	return sh.wb.writeDOT(w, []*Sheet{sh})
+}
+
+// WriteDOT writes the dependency graph of every formula in the workbook,
+// each sheet in its own cluster.
+func (wb *Workbook) WriteDOT(w io.Writer) error {
+	wb.mu.RLock()
+	defer wb.mu.RUnlock()
+	return wb.writeDOT(w, wb.sheets)
+}
+
+type dotNode struct {
+	sh    *Sheet
+	label string
+	attrs string
+}
+
+func (wb *Workbook) writeDOT(w io.Writer, sheets []*Sheet) error {
+	cyclic := make(map[cellKey]struct{})
+	for _, scc := range wb.cycles() {
+		for _, k := range scc {
+			cyclic[k] = struct{}{}
+		}
+	}
+	nodes := make(map[string]dotNode)
+	edges := make(map[[2]string]string) // from, to -> attributes
+	cellNode := func(k cellKey) string {
+		id := sheetPrefix(k.sh.name) + k.ref
+		if _, ok := nodes[id]; ok {
+			return id
+		}
+		c := k.cell()
+		n := dotNode{sh: k.sh, label: k.ref}
+		if c != nil && c.raw != "" {
+			n.label += " = " + displayText(c.val)
+		}
+		if c != nil && (c.ast != nil || c.parseErr != nil) {
+			n.label += "\n" + c.raw
+			n.attrs = `shape=ellipse`
+		} else {
+			n.attrs = `shape=plaintext`
+		}
+		if hasKey(cyclic, k) {
+			n.attrs += ` style=filled fillcolor="#f4cccc"`
+		}
+		nodes[id] = n
+		return id
+	}
+	for _, sh := range sheets {
+		for ref, c := range sh.grid {
+			if c.ast == nil {
+				continue
+			}
+			self := cellKey{sh, ref}
+			to := cellNode(self)
+			for d := range c.deps {
+				edges[[2]string{cellNode(d), to}] = ""
+			}
+			for _, r := range c.ranges {
+				id := sheetPrefix(r.sh.name) + r.g.String()
+				if _, ok := nodes[id]; !ok {
+					nodes[id] = dotNode{sh: r.sh, label: r.g.String(), attrs: "shape=box"}
+					for member, cl := range r.sh.grid {
+						if cl.raw != "" && r.g.contains(splitRef(member)) {
+							edges[[2]string{cellNode(cellKey{r.sh, member}), id}] = " [style=dashed]"
+						}
+					}
+				}
+				edges[[2]string{id, to}] = ""
+			}
+		}
+	}
+
+	ids := slices.Sorted(maps.Keys(nodes))
+	bw := bufio.NewWriter(w)
+	bw.WriteString("digraph dependencies {\n\trankdir=LR;\n\tnode [fontname=\"Helvetica\"];\n")
+	for i, sh := range wb.sheets {
+		var members []string
+		for _, id := range ids {
+			if nodes[id].sh == sh {
+				members = append(members, id)
+			}
+		}
+		if len(members) == 0 {
+			continue
+		}
+		indent := "\t"
+		if sh.name != "" {
+			fmt.Fprintf(bw, "\tsubgraph cluster_%d {\n\t\tlabel=%s;\n", i, dotQuote(sh.name))
+			indent = "\t\t"
+		}
+		for _, id := range members {
+			fmt.Fprintf(bw, "%s%s [label=%s %s];\n", indent, dotQuote(id), dotQuote(nodes[id].label), nodes[id].attrs)
+		}
+		if sh.name != "" {
+			bw.WriteString("\t}\n")
+		}
+	}
+	links := slices.SortedFunc(maps.Keys(edges), func(a, b [2]string) int {
+		return cmp.Or(strings.Compare(a[0], b[0]), strings.Compare(a[1], b[1]))
+	})
+	for _, e := range links {
+		fmt.Fprintf(bw, "\t%s -> %s%s;\n", dotQuote(e[0]), dotQuote(e[1]), edges[e])
+	}
+	bw.WriteString("}\n")
+	return bw.Flush()
+}
+
+// dotQuote makes s a DOT string, with newlines as line breaks.
+func dotQuote(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+	return `"` + s + `"`
+}
+
+// ---------- inserting and deleting rows and columns ----------
+
+// InsertRows inserts n empty rows before row at. Cells below move down,
+// formulas anywhere in the workbook follow the cells they referenced, and
+// ranges that span the insertion point grow.
+func (sh *Sheet) InsertRows(at, n int) error { return sh.shiftCells(lineShift{at: at, n: n}, n) }
+
+// DeleteRows removes n rows starting at row at. Cells below move up,
+// ranges shrink, and references to deleted cells, or to ranges deleted as
+// a whole, become #REF!.
+func (sh *Sheet) DeleteRows(at, n int) error { return sh.shiftCells(lineShift{at: at, n: -n}, n) }
+
+// InsertColumns is InsertRows for columns; column 1 is A.
+func (sh *Sheet) InsertColumns(at, n int) error {
+	return sh.shiftCells(lineShift{cols: true, at: at, n: n}, n)
+}
+
+// DeleteColumns is DeleteRows for columns; column 1 is A.
+func (sh *Sheet) DeleteColumns(at, n int) error {
+	return sh.shiftCells(lineShift{cols: true, at: at, n: -n}, n)
+}
+
+// lineShift is an insertion (n > 0) or deletion (n < 0) of |n| rows or
+// columns starting at index at.
+type lineShift struct {
+	cols bool
+	at   int
+	n    int
+}
+
+// index moves one row or column index; false means it was deleted.
+func (s lineShift) index(i int) (int, bool) {
+	switch {
+	case i < s.at:
+		return i, true
+	case s.n > 0:
+		return i + s.n, true
+	case i < s.at-s.n:
+		return 0, false
+	}
+	return i + s.n, true
+}
+
+// span moves the extent lo..hi of a range; false means all of it was
+// deleted.
+func (s lineShift) span(lo, hi int) (int, int, bool) {
+	if s.n > 0 {
+		lo, _ = s.index(lo)
+		hi, _ = s.index(hi)
+		return lo, hi, true
+	}
+	end := s.at - s.n // first line after the deleted block
+	if lo >= s.at && hi < end {
+		return 0, 0, false
+	}
+	if lo >= end {
+		lo += s.n
+	} else if lo >= s.at {
+		lo = s.at
+	}
+	if hi >= end {
+		hi += s.n
+	} else if hi >= s.at {
+		hi = s.at - 1
+	}
+	return lo, hi, true
+}
+
+func (s lineShift) ref(ref string) (string, bool) {
+	row, col := splitRef(ref)
+	var ok bool
+	if s.cols {
+		col, ok = s.index(col)
+	} else {
+		row, ok = s.index(row)
+	}
+	return cellName(row, col), ok
+}
+
+func (s lineShift) rng(g cellRange) (cellRange, bool) {
+	var ok bool
+	if s.cols {
+		g.c1, g.c2, ok = s.span(g.c1, g.c2)
+	} else {
+		g.r1, g.r2, ok = s.span(g.r1, g.r2)
+	}
+	return g, ok
+}
+
+func (sh *Sheet) shiftCells(s lineShift, count int) error {
+	if s.at < 1 || count < 1 {
+		return fmt.Errorf("invalid position %d or count %d", s.at, count)
+	}
+
+	sh.wb.mu.Lock()
+	defer sh.wb.unlock()
+
+	if sh.deleted {
+		return fmt.Errorf("sheet %q was deleted", sh.name)
+	}
+	defer sh.wb.track()()
+	removed, rewritten := sh.shift(s)
+	sh.wb.rec.add(&shiftEdit{sh, s, removed, rewritten})
+	err := sh.wb.refuseCycle()
+	sh.wb.recalc()
+	return err
+}
+
+// shift moves the cells and rewrites the references to them, returning
+// what it deleted and the formula text it replaced.
+func (sh *Sheet) shift(s lineShift) (removed map[string]*cell, rewritten map[*cell]string) {
+	removed = sh.moveCells(s)
+	rewritten = sh.wb.rewriteRefs(s.rewriter(sh))
+	sh.wb.relink()
+	return removed, rewritten
+}
+
+// rewriter is the reference rewrite that goes with shifting the cells of
+// sh: references to sh follow their cells, and references to deleted cells
+// or to ranges deleted as a whole become #REF!.
+func (s lineShift) rewriter(sh *Sheet) func(owner *Sheet, e expr) (expr, bool) {
+	return func(owner *Sheet, e expr) (expr, bool) {
+		switch e := e.(type) {
+		case refExpr:
+			if owner.resolve(e.sheet) != sh {
+				break
+			}
+			to, ok := s.ref(e.ref)
+			if !ok {
+				return errorLit(ErrRef), true
+			}
+			moved := to != e.ref
+			e.ref = to
+			return e, moved
+		case rangeExpr:
+			if owner.resolve(e.sheet) != sh {
+				break
+			}
+			g, ok := s.rng(e.g)
+			if !ok {
+				return errorLit(ErrRef), true
+			}
+			moved := g != e.g
+			e.g = g
+			return e, moved
+		}
+		return e, false
+	}
+}
+
+// moveCells moves cells to their shifted refs and returns the ones dropped
+// by a deletion. Pending cells are brought up to date first, since their
+// keys would no longer name them; that happens when a batch is redone.
+func (sh *Sheet) moveCells(s lineShift) map[string]*cell {
+	sh.wb.recalc()
+	grid := make(map[string]*cell, len(sh.grid))
+	removed := make(map[string]*cell)
+	for ref, c := range sh.grid {
+		sh.wb.noteOld(cellKey{sh, ref})
+		if to, ok := s.ref(ref); ok {
+			sh.wb.noteOld(cellKey{sh, to})
+			grid[to] = c
+		} else {
+			removed[ref] = c
+		}
+	}
+	sh.grid = grid
+	return removed
+}
+
+// ---------- copy, paste and fill ----------
+
+// Copy pastes the cells of src, a cell or range such as "A1:B3", number
+// formats included, with its top-left corner at dst. Blank source cells
+// clear their destination. Formulas move their relative references by the
+// distance pasted while $-anchored coordinates stay put, and references
+// pushed off the sheet become #REF!.
+func (sh *Sheet) Copy(src, dst string) error {
+	g, err := parseRange(src)
+	if err != nil {
+		return err
+	}
+	to, ok := normRef(dst)
+	if !ok {
+		return fmt.Errorf("invalid ref: %s", dst)
+	}
+	row, col := splitRef(to)
+	dr, dc := row-g.r1, col-g.c1
+
+	sh.wb.mu.Lock()
+	defer sh.wb.unlock()
+
+	if sh.deleted {
+		return fmt.Errorf("sheet %q was deleted", sh.name)
+	}
+	defer sh.wb.track()()
+	// read the whole source first, since it may overlap the destination
+	var pastes []paste
+	for r := g.r1; r <= g.r2; r++ {
+		for c := g.c1; c <= g.c2; c++ {
+			from := cellName(r, c)
+			pastes = append(pastes, paste{cellName(r+dr, c+dc), pastedRaw(sh.rawAt(from), dr, dc), sh.formatAt(from)})
+		}
+	}
+	return sh.applyPastes(pastes)
+}
+
+// FillDown copies the top row of rng into every row below it, as Ctrl+D
+// does in spreadsheets.
+func (sh *Sheet) FillDown(rng string) error { return sh.fill(rng, true) }
+
+// FillRight copies the leftmost column of rng into every column to its
+// right, as Ctrl+R does.
+func (sh *Sheet) FillRight(rng string) error { return sh.fill(rng, false) }
+
+func (sh *Sheet) fill(rng string, down bool) error {
+	g, err := parseRange(rng)
+	if err != nil {
+		return err
+	}
+
+	sh.wb.mu.Lock()
+	defer sh.wb.unlock()
+
+	if sh.deleted {
+		return fmt.Errorf("sheet %q was deleted", sh.name)
+	}
+	defer sh.wb.track()()
+	var pastes []paste
+	for r := g.r1; r <= g.r2; r++ {
+		for c := g.c1; c <= g.c2; c++ {
+			sr, sc := r, g.c1
+			if down {
+				sr, sc = g.r1, c
+			}
+			if r != sr || c != sc {
+				from := cellName(sr, sc)
+				pastes = append(pastes, paste{cellName(r, c), pastedRaw(sh.rawAt(from), r-sr, c-sc), sh.formatAt(from)})
+			}
+		}
+	}
+	return sh.applyPastes(pastes)
+}
+
+type paste struct {
+	ref, raw, format string
+}
+
+// applyPastes assigns the pasted inputs and formats and recalculates once.
+// Callers hold the write lock and track the operation.
+func (sh *Sheet) applyPastes(pastes []paste) error {
+	for _, p := range pastes {
+		if _, exists := sh.grid[p.ref]; exists || p.raw != "" {
+			sh.assign(p.ref, p.raw)
+		}
+		sh.setFormat(p.ref, p.format)
+	}
+	err := sh.wb.refuseCycle()
+	sh.wb.recalc()
+	return err
+}
+
+func (sh *Sheet) rawAt(ref string) string {
+	if c, ok := sh.grid[ref]; ok {
+		return c.raw
+	}
+	return ""
+}
+
+func (sh *Sheet) formatAt(ref string) string {
+	if c, ok := sh.grid[ref]; ok {
+		return c.format
+	}
+	return ""
+}
+
+// pastedRaw is the input raw becomes when pasted dr rows down and dc
+// columns right. Literals and formulas that do not parse are unchanged.
+func pastedRaw(raw string, dr, dc int) string {
+	if !strings.HasPrefix(raw, "=") {
+		return raw
+	}
+	ast, err := parseFormula(raw[1:])
+	if err != nil {
+		return raw
+	}
+	if ast, changed := offsetRefs(ast, dr, dc); changed {
+		return "=" + formatExpr(ast)
+	}
+	return raw
+}
+
+// offsetRefs moves the relative coordinates of every reference in e.
+func offsetRefs(e expr, dr, dc int) (expr, bool) {
+	return mapRefs(e, func(e expr) (expr, bool) {
+		switch e := e.(type) {
+		case refExpr:
+			row, col := splitRef(e.ref)
+			row, col = e.abs.offset(row, col, dr, dc)
+			if row < 1 || col < 1 {
+				return errorLit(ErrRef), true
+			}
+			to := cellName(row, col)
+			moved := to != e.ref
+			e.ref = to
+			return e, moved
+		case rangeExpr:
+			r1, c1 := e.abs1.offset(e.g.r1, e.g.c1, dr, dc)
+			r2, c2 := e.abs2.offset(e.g.r2, e.g.c2, dr, dc)
+			if min(r1, c1, r2, c2) < 1 {
+				return errorLit(ErrRef), true
+			}
+			g := newRangeExpr(e.sheet, r1, c1, e.abs1, r2, c2, e.abs2)
+			return g, g != e
+		}
+		return e, false
+	})
+}
+
+// ---------- defined names ----------
+
+var definedNameRe = regexp.MustCompile(`^[A-Z_][A-Z0-9_.]*$`)
+
+// DefineName gives a name to a range, a cell or a formula on this sheet,
+// so its formulas can say =SUM(Revenue) or =A1*(1+TaxRate). def is written
+// like a formula body, with or without the leading "=": "B2:B13", "0.2",
+// "Rates!B1*2". Redefining a name recalculates its users, and an empty def
+// removes the name, turning its users into #NAME?. Names are matched
+// without regard to case and follow their cells through row and column
+// edits and sheet renames.
+func (sh *Sheet) DefineName(name, def string) error {
+	key := strings.ToUpper(strings.TrimSpace(name))
+	if !definedNameRe.MatchString(key) || cellRefRe.MatchString(key) || key == "TRUE" || key == "FALSE" {
+		return fmt.Errorf("invalid name %q", name)
+	}
+	raw := ""
+	if def = strings.TrimPrefix(strings.TrimSpace(def), "="); def != "" {
+		raw = "=" + def
+		if _, err := parseFormula(def); err != nil {
+			return fmt.Errorf("name %s: %w", key, err)
+		}
+	}
+
+	sh.wb.mu.Lock()
+	defer sh.wb.unlock()
+
+	if sh.deleted {
+		return fmt.Errorf("sheet %q was deleted", sh.name)
+	}
+	before := ""
+	if c, ok := sh.names[key]; ok {
+		before = c.raw
+	}
+	sh.putName(key, raw)
+	if raw != "" && sh.nameReaches(key, sh.names[key].ast) {
+		sh.putName(key, before)
+		return fmt.Errorf("name %s refers to itself", key)
+	}
+	defer sh.wb.track()()
+	sh.wb.rec.add(nameEdit{sh, key, before, raw})
+	sh.wb.relink()
+	err := sh.wb.refuseCycle()
+	sh.wb.recalc()
+	return err
+}
+
+func (sh *Sheet) putName(key, raw string) {
+	if raw == "" {
+		delete(sh.names, key)
+		return
+	}
+	c := &cell{raw: raw}
+	c.parse()
+	sh.names[key] = c
+}
+
+// nameReaches reports whether e uses the name key, directly or through the
+// definitions of the names it uses. Definitions never form such a loop, so
+// formulas can expand names without a guard.
+func (sh *Sheet) nameReaches(key string, e expr) bool {
+	seen := map[nameExpr]bool{}
+	found := false
+	var visit func(e expr)
+	visit = func(e expr) {
+		n, ok := e.(nameExpr)
+		if !ok || found || seen[n] {
+			return
+		}
+		seen[n] = true
+		if string(n) == key {
+			found = true
+		} else if def, ok := sh.names[string(n)]; ok {
+			collectRefs(def.ast, visit)
+		}
+	}
+	collectRefs(e, visit)
+	return found
+}
+
+// nameEdit defines, redefines or removes a name.
+type nameEdit struct {
+	sh            *Sheet
+	name          string
+	before, after string
+}
+
+func (e nameEdit) undo() {
+	e.sh.putName(e.name, e.before)
+	e.sh.wb.relink()
+}
+
+func (e nameEdit) redo() {
+	e.sh.putName(e.name, e.after)
+	e.sh.wb.relink()
+}
+
+// ---------- change subscriptions ----------
+
+// CellChange is a cell whose value an edit changed, with values as Get
+// returns them.
+type CellChange struct {
+	Ref      string
+	Old, New any
+}
+
+type subscription struct {
+	sh  *Sheet
+	g   cellRange
+	all bool
+	fn  func([]CellChange)
+}
+
+// Subscribe calls fn after every edit that changes the value of a cell in
+// rng, such as "A1:D10", or anywhere on the sheet when rng is "". fn gets
+// the changed cells in row-major order; cells that were recalculated to
+// the value they had are left out. It runs in the goroutine that made the
+// edit once the edit is complete and the lock released, so it may read or
+// edit the workbook itself. The returned func ends the subscription.
+func (sh *Sheet) Subscribe(rng string, fn func([]CellChange)) (cancel func(), err error) {
+	sub := &subscription{sh: sh, fn: fn, all: rng == ""}
+	if !sub.all {
+		if sub.g, err = parseRange(rng); err != nil {
+			return nil, err
+		}
+	}
+
+	sh.wb.mu.Lock()
+	defer sh.wb.mu.Unlock()
+
+	if sh.wb.old == nil {
+		sh.wb.old = make(map[cellKey]any)
+	}
+	sh.wb.subs = append(sh.wb.subs, sub)
+	return func() {
+		sh.wb.mu.Lock()
+		defer sh.wb.mu.Unlock()
+		sh.wb.subs = slices.DeleteFunc(sh.wb.subs, func(s *subscription) bool { return s == sub })
+	}, nil
+}
+
+// noteOld remembers the value a cell had before the edit in progress first
+// touched it, as long as anyone is listening.
+func (wb *Workbook) noteOld(key cellKey) {
+	if len(wb.subs) == 0 {
+		return
+	}
+	if _, ok := wb.old[key]; !ok {
+		wb.old[key] = key.sh.valueAt(key.ref)
+	}
+}
+
+// unlock releases the write lock taken for an edit and then tells the
+// subscribers which of the cells it touched ended up with a new value.
+func (wb *Workbook) unlock() {
+	var calls []func()
+	if len(wb.old) > 0 {
+		for _, sub := range wb.subs {
+			var changes []CellChange
+			for key, before := range wb.old {
+				if key.sh != sub.sh || !sub.all && !sub.g.contains(splitRef(key.ref)) {
+					continue
+				}
+				if after := key.sh.valueAt(key.ref); after != before {
+					changes = append(changes, CellChange{Ref: key.ref, Old: blankAsEmpty(before), New: blankAsEmpty(after)})
+				}
+			}
+			if len(changes) > 0 {
+				sort.Slice(changes, func(i, j int) bool {
+					ri, ci := splitRef(changes[i].Ref)
+					rj, cj := splitRef(changes[j].Ref)
+					return ri < rj || ri == rj && ci < cj
+				})
+				fn := sub.fn
+				calls = append(calls, func() { fn(changes) })
+			}
+		}
+		clear(wb.old)
+	}
+	wb.mu.Unlock()
+	for _, call := range calls {
+		call()
+	}
+}
+
+func blankAsEmpty(v any) any {
+	if v == nil {
+		return ""
+	}
+	return v
+}
+
+// ---------- rendering and the terminal viewer ----------
+
+// maxColumnWidth caps auto-sized columns; longer values are cut with "…".
+const maxColumnWidth = 24
+
+// Render writes rng, or the used range when rng is "", as a grid with
+// column letters across the top and row numbers down the side, each value
+// shown as Display returns it. Columns are as wide as their widest value;
+// numbers align right, text left, and booleans and errors are centred, the
+// way spreadsheets show them.
+func (sh *Sheet) Render(w io.Writer, rng string) error {
+	var g cellRange
+	if rng != "" {
+		var err error
+		if g, err = parseRange(rng); err != nil {
+			return err
+		}
+	}
+
+	sh.wb.mu.RLock()
+	defer sh.wb.mu.RUnlock()
+
+	if rng == "" {
+		var ok bool
+		if g, ok = sh.usedRange(); !ok {
+			return nil
+		}
+	}
+	return sh.render(w, g, "", "\n")
+}
+
+// Print renders the used range to standard output.
+func (sh *Sheet) Print() {
+	_ = sh.Render(os.Stdout, "")
+}
+
+// render draws g with lines ending in eol, showing the cell at cursor, if
+// any, in reverse video. Callers hold the read lock.
+func (sh *Sheet) render(w io.Writer, g cellRange, cursor string, eol string) error {
+	widths := make([]int, g.c2-g.c1+1)
+	for i := range widths {
+		widths[i] = len(colName(g.c1 + i))
+	}
+	for ref, c := range sh.grid {
+		if row, col := splitRef(ref); c.raw != "" && g.contains(row, col) {
+			n := utf8.RuneCountInString(c.display())
+			widths[col-g.c1] = max(widths[col-g.c1], min(n, maxColumnWidth))
+		}
+	}
+	gutter := len(strconv.Itoa(g.r2))
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString(strings.Repeat(" ", gutter))
+	for i, width := range widths {
+		bw.WriteString(" " + alignText(colName(g.c1+i), true, width))
+	}
+	bw.WriteString(eol)
+	for r := g.r1; r <= g.r2; r++ {
+		fmt.Fprintf(bw, "%*d", gutter, r)
+		for c := g.c1; c <= g.c2; c++ {
+			text := strings.Repeat(" ", widths[c-g.c1])
+			if cl, ok := sh.grid[cellName(r, c)]; ok {
+				text = alignValue(cl.val, cl.display(), widths[c-g.c1])
+			}
+			if cellName(r, c) == cursor {
+				text = "\x1b[7m" + text + "\x1b[0m"
+			}
+			bw.WriteString(" " + text)
+		}
+		bw.WriteString(eol)
+	}
+	return bw.Flush()
+}
+
+// alignValue pads text, the display of v, to width the way v's type aligns.
+func alignValue(v any, text string, width int) string {
+	switch v.(type) {
+	case float64:
+		return strings.Repeat(" ", max(width-utf8.RuneCountInString(text), 0)) + fitText(text, width)
+	case bool, CellError:
+		return alignText(text, true, width)
+	}
+	return alignText(text, false, width)
+}
+
+// alignText pads text to width, centred or left-aligned.
+func alignText(text string, centre bool, width int) string {
+	text = fitText(text, width)
+	pad := width - utf8.RuneCountInString(text)
+	left := 0
+	if centre {
+		left = pad / 2
+	}
+	return strings.Repeat(" ", left) + text + strings.Repeat(" ", pad-left)
+}
+
+func fitText(text string, width int) string {
+	if utf8.RuneCountInString(text) <= width {
+		return text
+	}
+	return string([]rune(text)[:width-1]) + "…"
+}
+
+// Input returns what was entered into ref: the formula text for formulas,
+// "" for blank cells.
+func (sh *Sheet) Input(ref string) string {
+	sh.wb.mu.RLock()
+	defer sh.wb.mu.RUnlock()
+	ref, _ = normRef(ref)
+	return sh.rawAt(ref)
+}
+
+// RunTUI shows the sheet as an interactive grid on the terminal. Arrow keys
+// and Tab move, typing or Enter edits the current cell, Enter commits the
+// edit through Set and Esc drops it, Delete or Backspace clears the cell,
+// Ctrl-Z and Ctrl-Y undo and redo, and Ctrl-Q or Ctrl-C quits. The
+// terminal is switched to raw mode with stty for the duration.
+func (sh *Sheet) RunTUI() error {
+	if err := stty("raw", "-echo"); err != nil {
+		return fmt.Errorf("tui needs a terminal: %w", err)
+	}
+	defer stty("sane")
+	defer fmt.Print("\x1b[H\x1b[2J")
+	return sh.tui(os.Stdin, os.Stdout, 20, 8)
+}
+
+func stty(args ...string) error {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	return cmd.Run()
+}
+
+// key is a typed rune, or one of the negative special keys below.
+type key rune
+
+const (
+	keyNone key = -1 - iota
+	keyUp
+	keyDown
+	keyRight
+	keyLeft
+	keyTab
+	keyEnter
+	keyEsc
+	keyBackspace
+	keyDelete
+	keyUndo
+	keyRedo
+	keyQuit
+)
+
+// readKey decodes one key press from a raw terminal. An Esc with nothing
+// buffered after it is the Esc key itself rather than the start of an
+// escape sequence, which terminals send in one piece.
+func readKey(r *bufio.Reader) (key, error) {
+	ch, _, err := r.ReadRune()
+	if err != nil {
+		return keyNone, err
+	}
+	switch ch {
+	case 0x03, 0x11:
+		return keyQuit, nil
+	case 0x1a:
+		return keyUndo, nil
+	case 0x19:
+		return keyRedo, nil
+	case '\r', '\n':
+		return keyEnter, nil
+	case '\t':
+		return keyTab, nil
+	case 0x7f, 0x08:
+		return keyBackspace, nil
+	case 0x1b:
+		if next, err := r.Peek(1); r.Buffered() == 0 || err != nil || next[0] != '[' {
+			return keyEsc, nil
+		}
+		r.ReadByte()
+		code, err := r.ReadByte()
+		if err != nil {
+			return keyNone, err
+		}
+		switch code {
+		case 'A':
+			return keyUp, nil
+		case 'B':
+			return keyDown, nil
+		case 'C':
+			return keyRight, nil
+		case 'D':
+			return keyLeft, nil
+		case '3':
+			if tilde, _ := r.ReadByte(); tilde == '~' {
+				return keyDelete, nil
+			}
+		}
+		return keyNone, nil
+	}
+	if ch < ' ' {
+		return keyNone, nil
+	}
+	return key(ch), nil
+}
+
+// tui runs the RunTUI loop over any key stream, showing rows by cols cells
+// at a time, until the stream ends or the user quits.
+func (sh *Sheet) tui(in io.Reader, out io.Writer, rows, cols int) error {
+	keys := bufio.NewReader(in)
+	row, col, top, left := 1, 1, 1, 1
+	editing, buf, status := false, []rune(nil), ""
+	for {
+		top = min(max(top, row-rows+1), row)
+		left = min(max(left, col-cols+1), col)
+		ref := cellName(row, col)
+		if err := sh.drawTUI(out, cellRange{top, left, top + rows - 1, left + cols - 1}, ref, editing, buf, status); err != nil {
+			return err
+		}
+
+		k, err := readKey(keys)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		status = ""
+		if editing {
+			switch {
+			case k == keyEnter:
+				editing = false
+				if err := sh.Set(ref, string(buf)); err != nil {
+					status = err.Error()
+				} else {
+					row++
+				}
+			case k == keyEsc:
+				editing = false
+			case k == keyBackspace:
+				if len(buf) > 0 {
+					buf = buf[:len(buf)-1]
+				}
+			case k == keyQuit:
+				return nil
+			case k > 0:
+				buf = append(buf, rune(k))
+			}
+			continue
+		}
+		switch {
+		case k == keyUp:
+			row = max(row-1, 1)
+		case k == keyDown:
+			row++
+		case k == keyLeft:
+			col = max(col-1, 1)
+		case k == keyRight || k == keyTab:
+			col++
+		case k == keyEnter:
+			editing, buf = true, []rune(sh.Input(ref))
+		case k == keyDelete || k == keyBackspace:
+			_ = sh.Set(ref, "")
+		case k == keyUndo:
+			if !sh.Undo() {
+				status = "nothing to undo"
+			}
+		case k == keyRedo:
+			if !sh.Redo() {
+				status = "nothing to redo"
+			}
+		case k == keyQuit:
+			return nil
+		case k > 0:
+			editing, buf = true, []rune{rune(k)}
+		}
+	}
+}
+
+func (sh *Sheet) drawTUI(out io.Writer, view cellRange, cursor string, editing bool, buf []rune, status string) error {
+	var screen bytes.Buffer
+	screen.WriteString("\x1b[H\x1b[2J")
+
+	sh.wb.mu.RLock()
+	err := sh.render(&screen, view, cursor, "\r\n")
+	line := cursor + ":"
+	switch c, ok := sh.grid[cursor]; {
+	case editing:
+		line = fmt.Sprintf("%s> %s_", cursor, string(buf))
+	case ok && c.raw != "":
+		line = fmt.Sprintf("%s: %s = %s", cursor, c.raw, c.display())
+	}
+	sh.wb.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	screen.WriteString("\r\n" + line + "\r\n")
+	if status != "" {
+		screen.WriteString(status + "\r\n")
+	}
+	screen.WriteString("arrows move · type or Enter to edit · Esc cancels · Del clears · ^Z/^Y undo/redo · ^Q quits\r\n")
+	_, err = out.Write(screen.Bytes())
+	return err
+}
+
+// ---------- undo and redo ----------
+
+// historyLimit is how many undo steps a workbook keeps by default.
+const historyLimit = 100
+
+// command is one undoable step. Both methods run under the write lock and
+// leave the recalculation to the caller.
+type command interface {
+	undo()
+	redo()
+}
+
+// cellEdit replaces the input of one cell.
+type cellEdit struct {
+	sh            *Sheet
+	ref           string
+	before, after string
+}
+
+func (e cellEdit) undo() { e.sh.assign(e.ref, e.before) }
+func (e cellEdit) redo() { e.sh.assign(e.ref, e.after) }
+
+// formatEdit changes the number format of one cell.
+type formatEdit struct {
+	sh            *Sheet
+	ref           string
+	before, after string
+}
+
+func (e formatEdit) undo() { e.sh.ensure(e.ref).format = e.before }
+func (e formatEdit) redo() { e.sh.ensure(e.ref).format = e.after }
+
+// shiftEdit inserts or deletes rows or columns. Undoing it moves the cells
+// back and restores what the shift destroyed: the deleted cells and the
+// text of every formula whose references were rewritten, #REF! included.
+type shiftEdit struct {
+	sh        *Sheet
+	s         lineShift
+	removed   map[string]*cell
+	rewritten map[*cell]string
+}
+
+func (e *shiftEdit) undo() {
+	back := e.s
+	back.n = -back.n
+	e.sh.moveCells(back)
+	for ref, c := range e.removed {
+		e.sh.grid[ref] = c
+	}
+	for c, raw := range e.rewritten {
+		c.raw = raw
+		c.parse()
+	}
+	e.sh.wb.relink()
+}
+
+func (e *shiftEdit) redo() { e.removed, e.rewritten = e.sh.shift(e.s) }
+
+// batch is a group of commands undone and redone as one.
+type batch []command
+
+func (b batch) undo() {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i].undo()
+	}
+}
+
+func (b batch) redo() {
+	for _, cmd := range b {
+		cmd.redo()
+	}
+}
+
+func (b *batch) add(cmd command) { *b = append(*b, cmd) }
+
+type history struct {
+	done, undone []command
+	limit        int
+
+	// open gathers the steps made between BeginBatch and EndBatch.
+	open  batch
+	depth int
+}
+
+// push files the commands of one operation as a single step.
+func (h *history) push(b batch) {
+	var cmd command
+	switch len(b) {
+	case 0:
+		return
+	case 1:
+		cmd = b[0]
+	default:
+		cmd = b
+	}
+	if h.depth > 0 {
+		h.open.add(cmd)
+		return
+	}
+	h.done = append(h.done, cmd)
+	if over := len(h.done) - h.limit; over > 0 {
+		h.done = slices.Delete(h.done, 0, over)
+	}
+	h.undone = nil
+}
+
+func (h *history) clear() {
+	h.done, h.undone, h.open = nil, nil, nil
+}
+
+// track starts recording the cell edits of one operation. The returned
+// func files them as a single undo step; callers defer it under the write
+// lock.
+func (wb *Workbook) track() func() {
+	wb.rec = &batch{}
+	return func() {
+		rec := wb.rec
+		wb.rec = nil
+		wb.hist.push(*rec)
+	}
+}
+
+// Undo reverts the most recent edit, or batch of edits, on any sheet of the
+// workbook and reports whether it did: there may be none to revert, or in
+// strict mode reverting it would bring back a cycle.
+func (wb *Workbook) Undo() bool {
+	wb.mu.Lock()
+	defer wb.unlock()
+
+	h := &wb.hist
+	if len(h.done) == 0 {
+		return false
+	}
+	cmd := h.done[len(h.done)-1]
+	cmd.undo()
+	if wb.closedCycle() != nil {
+		cmd.redo()
+		wb.recalc()
+		return false
+	}
+	h.done = h.done[:len(h.done)-1]
+	h.undone = append(h.undone, cmd)
+	wb.recalc()
+	return true
+}
+
+// Redo applies the most recently undone step again, unless in strict mode
+// that would close a cycle. Any new edit empties the redo stack.
+func (wb *Workbook) Redo() bool {
+	wb.mu.Lock()
+	defer wb.unlock()
+
+	h := &wb.hist
+	if len(h.undone) == 0 {
+		return false
+	}
+	cmd := h.undone[len(h.undone)-1]
+	cmd.redo()
+	if wb.closedCycle() != nil {
+		cmd.undo()
+		wb.recalc()
+		return false
+	}
+	h.undone = h.undone[:len(h.undone)-1]
+	h.done = append(h.done, cmd)
+	wb.recalc()
+	return true
+}
+
+// BeginBatch groups the edits made until the matching EndBatch into one
+// undo step. Batches nest, and edits made by other goroutines in between
+// join the batch as well.
+func (wb *Workbook) BeginBatch() {
+	wb.mu.Lock()
+	defer wb.unlock()
+	wb.hist.depth++
+}
+
+// EndBatch closes the innermost open batch.
+func (wb *Workbook) EndBatch() {
+	wb.mu.Lock()
+	defer wb.unlock()
+
+	h := &wb.hist
+	if h.depth == 0 {
+		return
+	}
+	if h.depth--; h.depth == 0 {
+		open := h.open
+		h.open = nil
+		h.push(open)
+	}
+}
+
+// SetHistoryLimit bounds the number of undo steps kept, dropping the
+// oldest ones beyond it; 0 turns undo off.
+func (wb *Workbook) SetHistoryLimit(n int) {
+	wb.mu.Lock()
+	defer wb.unlock()
+
+	wb.hist.limit = max(n, 0)
+	if over := len(wb.hist.done) - wb.hist.limit; over > 0 {
+		wb.hist.done = slices.Delete(wb.hist.done, 0, over)
+	}
+}
+
+// Undo, Redo, BeginBatch and EndBatch on a sheet act on the history of its
+// workbook, which for a standalone sheet is the sheet's own.
+func (sh *Sheet) Undo() bool  { return sh.wb.Undo() }
+func (sh *Sheet) Redo() bool  { return sh.wb.Redo() }
+func (sh *Sheet) BeginBatch() { sh.wb.BeginBatch() }
+func (sh *Sheet) EndBatch()   { sh.wb.EndBatch() }
+
+// literalValue types a non-formula input the way spreadsheets do on entry;
+// typing an error code such as #N/A enters that error, a date such as
+// 2024-03-15 or a time such as 14:30 enters its serial number, and a
+// leading apostrophe forces the rest to stay text.
+func literalValue(raw string) any {
+	if raw == "" {
+		return nil
+	}
+	if text, ok := strings.CutPrefix(raw, "'"); ok {
+		return text
+	}
+	for _, e := range cellErrors {
+		if strings.EqualFold(raw, string(e)) {
+			return e
+		}
+	}
+	if f, err := strconv.ParseFloat(raw, 64); err == nil {
+		return f
+	}
+	switch strings.ToUpper(raw) {
+	case "TRUE":
+		return true
+	case "FALSE":
+		return false
+	}
+	if serial, _, ok := parseDateLiteral(raw); ok {
+		return serial
+	}
+	return raw
+}
+
+// ---------- formula language ----------
+//
+// Grammar, lowest precedence first (unary minus binds tighter than ^, as in
+// spreadsheets, so -2^2 is 4):
+//
+//	expr    = concat { ("=" | "<>" | "<" | "<=" | ">" | ">=") concat }
+//	concat  = sum { "&" sum }
+//	sum     = term { ("+" | "-") term }
+//	term    = power { ("*" | "/") power }
+//	power   = unary { "^" unary }
+//	unary   = ("+" | "-") unary | primary
+//	primary = number | string | TRUE | FALSE | error | [sheet "!"] ref [":" ref] | call | name | "(" expr ")"
+//	call    = name "(" [expr {"," expr}] ")"
+//	sheet   = name | "'" any text, with ' doubled "'"
+
+type tokKind int
+
+const (
+	tokEOF tokKind = iota
+	tokNumber
+	tokString
+	tokBool
+	tokError
+	tokName
+	tokRef
+	tokOp
+	tokLParen
+	tokRParen
+	tokColon
+	tokComma
+	tokFunc  // a name directly followed by "("
+	tokSheet // a sheet name and its "!", text without quotes
+)
+
+type token struct {
+	kind tokKind
+	text string
+	pos  int // byte offset into the formula, after the leading '='
+}
+
+// ParseError points at the offending position in the formula body.
+type ParseError struct {
+	Pos int
+	Msg string
+}
+
+func (e *ParseError) Error() string { return fmt.Sprintf("parse error at %d: %s", e.Pos, e.Msg) }
+
+func lex(src string) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(src); {
+		ch := src[i]
+		switch {
+		case ch == ' ' || ch == '\t':
+			i++
+		case strings.IndexByte("+-*/^&=", ch) >= 0:
+			toks = append(toks, token{tokOp, string(ch), i})
+			i++
+		case ch == '<' || ch == '>':
+			op := string(ch)
+			if i+1 < len(src) && (src[i+1] == '=' || ch == '<' && src[i+1] == '>') {
+				op = src[i : i+2]
+			}
+			toks = append(toks, token{tokOp, op, i})
+			i += len(op)
+		case ch == '"':
+			var sb strings.Builder
+			j := i + 1
+			for {
+				if j >= len(src) {
+					return nil, &ParseError{i, "unterminated string"}
+				}
+				if src[j] == '"' {
+					if j+1 < len(src) && src[j+1] == '"' {
+						sb.WriteByte('"')
+						j += 2
+						continue
+					}
+					break
+				}
+				sb.WriteByte(src[j])
+				j++
+			}
+			toks = append(toks, token{tokString, sb.String(), i})
+			i = j + 1
+		case ch == '\'':
+			var sb strings.Builder
+			j := i + 1
+			for {
+				if j >= len(src) {
+					return nil, &ParseError{i, "unterminated sheet name"}
+				}
+				if src[j] == '\'' {
+					if j+1 < len(src) && src[j+1] == '\'' {
+						sb.WriteByte('\'')
+						j += 2
+						continue
+					}
+					break
+				}
+				sb.WriteByte(src[j])
+				j++
+			}
+			if j+1 >= len(src) || src[j+1] != '!' {
+				return nil, &ParseError{i, "quoted sheet name must be followed by !"}
+			}
+			toks = append(toks, token{tokSheet, sb.String(), i})
+			i = j + 2
+		case ch == '(':
+			toks = append(toks, token{tokLParen, "(", i})
+			i++
+		case ch == ')':
+			toks = append(toks, token{tokRParen, ")", i})
+			i++
+		case ch == ':':
+			toks = append(toks, token{tokColon, ":", i})
+			i++
+		case ch == ',':
+			toks = append(toks, token{tokComma, ",", i})
+			i++
+		case ch >= '0' && ch <= '9' || ch == '.':
+			j := i
+			for j < len(src) && (src[j] >= '0' && src[j] <= '9' || src[j] == '.') {
+				j++
+			}
+			if j < len(src) && (src[j] == 'e' || src[j] == 'E') {
+				k := j + 1
+				if k < len(src) && (src[k] == '+' || src[k] == '-') {
+					k++
+				}
+				if k < len(src) && src[k] >= '0' && src[k] <= '9' {
+					for j = k; j < len(src) && src[j] >= '0' && src[j] <= '9'; j++ {
+					}
+				}
+			}
+			if _, err := strconv.ParseFloat(src[i:j], 64); err != nil {
+				return nil, &ParseError{i, fmt.Sprintf("bad number %q", src[i:j])}
+			}
+			toks = append(toks, token{tokNumber, src[i:j], i})
+			i = j
+		case ch == '#':
+			var code CellError
+			for _, e := range cellErrors {
+				if len(src)-i >= len(e) && strings.EqualFold(src[i:i+len(e)], string(e)) {
+					code = e
+					break
+				}
+			}
+			if code == "" {
+				return nil, &ParseError{i, "unknown error literal"}
+			}
+			toks = append(toks, token{tokError, string(code), i})
+			i += len(code)
+		case isNameStart(ch) || ch == '$':
+			j := i + 1
+			for j < len(src) && (isNameStart(src[j]) || src[j] >= '0' && src[j] <= '9' || src[j] == '.' || src[j] == '$') {
+				j++
+			}
+			if strings.Contains(src[i:j], "$") && !cellRefRe.MatchString(strings.ToUpper(src[i:j])) {
+				return nil, &ParseError{i, fmt.Sprintf("bad reference %q", src[i:j])}
+			}
+			if j < len(src) && src[j] == '!' {
+				toks = append(toks, token{tokSheet, src[i:j], i})
+				i = j + 1
+				continue
+			}
+			word := strings.ToUpper(src[i:j])
+			k := j
+			for k < len(src) && src[k] == ' ' {
+				k++
+			}
+			switch {
+			case k < len(src) && src[k] == '(':
+				toks = append(toks, token{tokFunc, word, i})
+			case word == "TRUE" || word == "FALSE":
+				toks = append(toks, token{tokBool, word, i})
+			case cellRefRe.MatchString(word):
+				toks = append(toks, token{tokRef, word, i})
+			default:
+				toks = append(toks, token{tokName, word, i})
+			}
+			i = j
+		default:
+			return nil, &ParseError{i, fmt.Sprintf("unexpected character %q", ch)}
+		}
+	}
+	return append(toks, token{tokEOF, "", len(src)}), nil
+}
+
+func isNameStart(ch byte) bool {
+	return ch >= 'A' && ch <= 'Z' || ch >= 'a' && ch <= 'z' || ch == '_'
+}
+
+type parser struct {
+	toks []token
+	pos  int
+}
+
+func parseFormula(src string) (expr, error) {
+	toks, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	e, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, &ParseError{t.pos, fmt.Sprintf("unexpected %q", t.text)}
+	}
+	return e, nil
+}
+
+func (p *parser) peek() token { return p.toks[p.pos] }
+
+func (p *parser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) acceptOp(ops ...string) (string, bool) {
+	t := p.peek()
+	if t.kind != tokOp {
+		return "", false
+	}
+	for _, op := range ops {
+		if t.text == op {
+			p.next()
+			return op, true
+		}
+	}
+	return "", false
+}
+
+// binary parses one left-associative precedence level.
+func (p *parser) binary(ops []string, operand func() (expr, error)) (expr, error) {
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.acceptOp(ops...)
+		if !ok {
+			return left, nil
+		}
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryExpr{op: op, l: left, r: right}
+	}
+}
+
+func (p *parser) expr() (expr, error) {
+	return p.binary([]string{"=", "<>", "<", "<=", ">", ">="}, p.concat)
+}
+func (p *parser) concat() (expr, error) { return p.binary([]string{"&"}, p.sum) }
+func (p *parser) sum() (expr, error)    { return p.binary([]string{"+", "-"}, p.term) }
+func (p *parser) term() (expr, error)   { return p.binary([]string{"*", "/"}, p.power) }
+func (p *parser) power() (expr, error)  { return p.binary([]string{"^"}, p.unary) }
+
+func (p *parser) unary() (expr, error) {
+	if op, ok := p.acceptOp("+", "-"); ok {
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryExpr{op: op, x: x}, nil
+	}
+	return p.primary()
+}
+
+func (p *parser) primary() (expr, error) {
+	t := p.next()
+	switch t.kind {
+	case tokNumber:
+		f, _ := strconv.ParseFloat(t.text, 64)
+		return numberLit(f), nil
+	case tokString:
+		return stringLit(t.text), nil
+	case tokBool:
+		return boolLit(t.text == "TRUE"), nil
+	case tokError:
+		return errorLit(t.text), nil
+	case tokName:
+		return nameExpr(t.text), nil
+	case tokRef:
+		return p.reference("", t)
+	case tokSheet:
+		ref := p.next()
+		if ref.kind != tokRef {
+			return nil, &ParseError{ref.pos, fmt.Sprintf("expected a cell reference after %s!", t.text)}
+		}
+		return p.reference(t.text, ref)
+	case tokFunc:
+		return p.call(t)
+	case tokLParen:
+		e, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if c := p.next(); c.kind != tokRParen {
+			return nil, &ParseError{c.pos, "missing )"}
+		}
+		return e, nil
+	case tokEOF:
+		return nil, &ParseError{t.pos, "unexpected end of formula"}
+	}
+	return nil, &ParseError{t.pos, fmt.Sprintf("unexpected %q", t.text)}
+}
+
+// reference parses a cell or, when a colon follows, a range; sheet is ""
+// for the formula's own sheet.
+func (p *parser) reference(sheet string, t token) (expr, error) {
+	if p.peek().kind != tokColon {
+		row, col, abs := parseAnchored(t.text)
+		return refExpr{sheet: sheet, ref: cellName(row, col), abs: abs}, nil
+	}
+	p.next()
+	end := p.next()
+	if end.kind != tokRef {
+		return nil, &ParseError{end.pos, "range needs a cell reference after :"}
+	}
+	r1, c1, abs1 := parseAnchored(t.text)
+	r2, c2, abs2 := parseAnchored(end.text)
+	return newRangeExpr(sheet, r1, c1, abs1, r2, c2, abs2), nil
+}
+
+// call parses a function call. Unknown functions still parse, as in
+// spreadsheets, and evaluate to #NAME?.
+func (p *parser) call(name token) (expr, error) {
+	spec, known := formulaFuncs[name.text]
+	p.next() // "("
+	call := &callExpr{name: name.text, fn: spec.fn}
+	if p.peek().kind == tokRParen {
+		p.next()
+	} else {
+		for done := false; !done; {
+			arg, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			call.args = append(call.args, arg)
+			switch t := p.next(); t.kind {
+			case tokComma:
+			case tokRParen:
+				done = true
+			default:
+				return nil, &ParseError{t.pos, fmt.Sprintf("expected , or ) in call to %s", name.text)}
+			}
+		}
+	}
+	if n := len(call.args); known && (n < spec.minArgs || spec.maxArgs >= 0 && n > spec.maxArgs) {
+		return nil, &ParseError{name.pos, fmt.Sprintf("%s takes %s argument(s), got %d", name.text, spec.arity(), n)}
+	}
+	return call, nil
+}
+
+// ---------- evaluation ----------
+
+type evalCtx struct {
+	sh *Sheet
+}
+
+type expr interface {
+	eval(ctx *evalCtx) any
+}
+
+type numberLit float64
+
+type stringLit string
+
+type boolLit bool
+
+type errorLit CellError
+
+// nameExpr is an identifier that is neither a cell nor a function: a
+// defined name, or #NAME? if there is none.
+type nameExpr string
+
+// refExpr and rangeExpr name the sheet they read as written in the
+// formula, "" for the formula's own sheet, and resolve it on evaluation.
+type refExpr struct {
+	sheet string
+	ref   string // without $ markers
+	abs   anchors
+}
+
+type unaryExpr struct {
+	op string
+	x  expr
+}
+
+type binaryExpr struct {
+	op   string
+	l, r expr
+}
+
+// abs1 holds the markers of r1 and c1, abs2 those of r2 and c2.
+type rangeExpr struct {
+	sheet      string
+	g          cellRange
+	abs1, abs2 anchors
+}
+
+// anchors records which coordinates of a reference are absolute, written
+// with $, and so stay put when the formula is copied elsewhere.
+type anchors struct {
+	row, col bool
+}
+
+func parseAnchored(ref string) (row, col int, abs anchors) {
+	abs.col = strings.HasPrefix(ref, "$")
+	abs.row = strings.Contains(ref[1:], "$")
+	row, col = splitRef(ref)
+	return row, col, abs
+}
+
+// offset moves the relative coordinates of a reference.
+func (a anchors) offset(row, col, dr, dc int) (int, int) {
+	if !a.row {
+		row += dr
+	}
+	if !a.col {
+		col += dc
+	}
+	return row, col
+}
+
+func (a anchors) name(row, col int) string {
+	var b strings.Builder
+	if a.col {
+		b.WriteByte('$')
+	}
+	b.WriteString(colName(col))
+	if a.row {
+		b.WriteByte('$')
+	}
+	b.WriteString(strconv.Itoa(row))
+	return b.String()
+}
+
+// newRangeExpr orders the corners of a range the way newRange does, each
+// coordinate keeping its own marker.
+func newRangeExpr(sheet string, r1, c1 int, abs1 anchors, r2, c2 int, abs2 anchors) rangeExpr {
+	if r1 > r2 {
+		r1, r2 = r2, r1
+		abs1.row, abs2.row = abs2.row, abs1.row
+	}
+	if c1 > c2 {
+		c1, c2 = c2, c1
+		abs1.col, abs2.col = abs2.col, abs1.col
+	}
+	return rangeExpr{sheet: sheet, g: cellRange{r1, c1, r2, c2}, abs1: abs1, abs2: abs2}
+}
+
+type callExpr struct {
+	name string
+	fn   formulaFunc
+	args []expr
+}
+
+// collectRefs calls fn for every reference, range and name in e.
+func collectRefs(e expr, fn func(expr)) {
+	switch e := e.(type) {
+	case refExpr, rangeExpr, nameExpr:
+		fn(e)
+	case *unaryExpr:
+		collectRefs(e.x, fn)
+	case *binaryExpr:
+		collectRefs(e.l, fn)
+		collectRefs(e.r, fn)
+	case *callExpr:
+		for _, a := range e.args {
+			collectRefs(a, fn)
+		}
+	}
+}
+
+// mapRefs replaces every reference and range in e with fn's result and
+// reports whether fn changed any of them. Operator and call nodes are
+// updated in place.
+func mapRefs(e expr, fn func(expr) (expr, bool)) (expr, bool) {
+	switch x := e.(type) {
+	case refExpr, rangeExpr:
+		return fn(e)
+	case *unaryExpr:
+		var changed bool
+		x.x, changed = mapRefs(x.x, fn)
+		return x, changed
+	case *binaryExpr:
+		var cl, cr bool
+		x.l, cl = mapRefs(x.l, fn)
+		x.r, cr = mapRefs(x.r, fn)
+		return x, cl || cr
+	case *callExpr:
+		changed := false
+		for i, a := range x.args {
+			var c bool
+			x.args[i], c = mapRefs(a, fn)
+			changed = changed || c
+		}
+		return x, changed
+	}
+	return e, false
+}
+
+// opPrec mirrors the parser's precedence levels, loosest first.
+var opPrec = map[string]int{
+	"=": 1, "<>": 1, "<": 1, "<=": 1, ">": 1, ">=": 1,
+	"&": 2,
+	"+": 3, "-": 3,
+	"*": 4, "/": 4,
+	"^": 5,
+}
+
+// unaryPrec is the level of a unary minus or plus, which binds tighter than
+// every binary operator, ^ included, so -2^2 is 4.
+const unaryPrec = 6
+
+// formatExpr turns a parsed formula back into text, without the leading
+// "=" and with only the parentheses precedence requires.
+func formatExpr(e expr) string {
+	var b strings.Builder
+	writeExpr(&b, e, 0)
+	return b.String()
+}
+
+func writeExpr(b *strings.Builder, e expr, prec int) {
+	switch e := e.(type) {
+	case numberLit:
+		b.WriteString(strconv.FormatFloat(float64(e), 'g', -1, 64))
+	case stringLit:
+		b.WriteString(`"` + strings.ReplaceAll(string(e), `"`, `""`) + `"`)
+	case boolLit:
+		b.WriteString(strings.ToUpper(strconv.FormatBool(bool(e))))
+	case errorLit:
+		b.WriteString(string(e))
+	case nameExpr:
+		b.WriteString(string(e))
+	case refExpr:
+		row, col := splitRef(e.ref)
+		b.WriteString(sheetPrefix(e.sheet) + e.abs.name(row, col))
+	case rangeExpr:
+		b.WriteString(sheetPrefix(e.sheet) + e.abs1.name(e.g.r1, e.g.c1) + ":" + e.abs2.name(e.g.r2, e.g.c2))
+	case *unaryExpr:
+		b.WriteString(e.op)
+		writeExpr(b, e.x, unaryPrec)
+	case *binaryExpr:
+		p := opPrec[e.op]
+		if p < prec {
+			b.WriteByte('(')
+		}
+		writeExpr(b, e.l, p)
+		b.WriteString(e.op)
+		writeExpr(b, e.r, p+1) // operators are left-associative
+		if p < prec {
+			b.WriteByte(')')
+		}
+	case *callExpr:
+		b.WriteString(e.name + "(")
+		for i, a := range e.args {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			writeExpr(b, a, 0)
+		}
+		b.WriteByte(')')
+	}
+}
+
+var plainSheetName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*$`)
+
+// sheetPrefix is the "Name!" in front of a reference, quoted when the name
+// would not lex back as a single sheet token.
+func sheetPrefix(name string) string {
+	switch {
+	case name == "":
+		return ""
+	case plainSheetName.MatchString(name) && !cellRefRe.MatchString(strings.ToUpper(name)):
+		return name + "!"
+	}
+	return "'" + strings.ReplaceAll(name, "'", "''") + "'!"
+}
+
+func isErrorValue(v any) bool {
+	_, ok := v.(CellError)
+	return ok
+}
+
+func (n numberLit) eval(*evalCtx) any { return float64(n) }
+func (t stringLit) eval(*evalCtx) any { return string(t) }
+func (b boolLit) eval(*evalCtx) any   { return bool(b) }
+func (e errorLit) eval(*evalCtx) any  { return CellError(e) }
+func (n nameExpr) eval(ctx *evalCtx) any {
+	if def, ok := ctx.sh.names[string(n)]; ok {
+		return def.ast.eval(ctx)
+	}
+	return ErrName
+}
+
+// refExpr yields the referenced cell's value, which already carries
+// #CIRCULAR! or a parse failure's #VALUE! as a CellError.
+// A reference to a sheet that does not exist is #REF!.
+func (r refExpr) eval(ctx *evalCtx) any {
+	sh := ctx.sh.resolve(r.sheet)
+	if sh == nil {
+		return ErrRef
+	}
+	return sh.valueAt(r.ref)
+}
+
+// A bare range is only meaningful as a function argument.
+func (g rangeExpr) eval(*evalCtx) any { return ErrValue }
+
+func (c *callExpr) eval(ctx *evalCtx) any {
+	if c.fn == nil {
+		return ErrName
+	}
+	return c.fn(ctx, c.args)
+}
+
+func (u *unaryExpr) eval(ctx *evalCtx) any {
+	x, errVal := toNumber(u.x.eval(ctx))
+	if errVal != nil {
+		return errVal
+	}
+	if u.op == "-" {
+		return -x
+	}
+	return x
+}
+
+func (b *binaryExpr) eval(ctx *evalCtx) any {
+	lv, rv := b.l.eval(ctx), b.r.eval(ctx)
+	switch b.op {
+	case "&":
+		ls, errVal := toText(lv)
+		if errVal != nil {
+			return errVal
+		}
+		rs, errVal := toText(rv)
+		if errVal != nil {
+			return errVal
+		}
+		return ls + rs
+	case "=", "<>", "<", "<=", ">", ">=":
+		if isErrorValue(lv) {
+			return lv
+		}
+		if isErrorValue(rv) {
+			return rv
+		}
+		cmp := compareValues(lv, rv)
+		switch b.op {
+		case "=":
+			return cmp == 0
+		case "<>":
+			return cmp != 0
+		case "<":
+			return cmp < 0
+		case "<=":
+			return cmp <= 0
+		case ">":
+			return cmp > 0
+		}
+		return cmp >= 0
+	}
+
+	lf, errVal := toNumber(lv)
+	if errVal != nil {
+		return errVal
+	}
+	rf, errVal := toNumber(rv)
+	if errVal != nil {
+		return errVal
+	}
+	var f float64
+	switch b.op {
+	case "+":
+		f = lf + rf
+	case "-":
+		f = lf - rf
+	case "*":
+		f = lf * rf
+	case "/":
+		if rf == 0 {
+			return ErrDiv0
+		}
+		f = lf / rf
+	case "^":
+		f = math.Pow(lf, rf)
+	default:
+		return ErrValue
+	}
+	return finite(f)
+}
+
+// finite passes f through unless it overflowed or, as (-8)^0.5 does, has
+// no real value; spreadsheets show #NUM! for both.
+func finite(f float64) any {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return ErrNum
+	}
+	return f
+}
+
+// ---------- coercion ----------
+//
+// Cell values are nil (blank), float64, string, bool or CellError. The to*
+// helpers follow spreadsheet coercion and hand back the CellError to
+// propagate when the conversion is impossible.
+
+func toNumber(v any) (float64, any) {
+	switch x := v.(type) {
+	case nil:
+		return 0, nil
+	case float64:
+		return x, nil
+	case bool:
+		if x {
+			return 1, nil
+		}
+		return 0, nil
+	case string:
+		if f, err := strconv.ParseFloat(strings.TrimSpace(x), 64); err == nil {
+			return f, nil
+		}
+	case CellError:
+		return 0, x
+	}
+	return 0, ErrValue
+}
+
+func toText(v any) (string, any) {
+	switch x := v.(type) {
+	case nil:
+		return "", nil
+	case float64:
+		return formatGeneral(x), nil
+	case bool:
+		if x {
+			return "TRUE", nil
+		}
+		return "FALSE", nil
+	case string:
+		return x, nil
+	case CellError:
+		return "", x
+	}
+	return "", ErrValue
+}
+
+func toBool(v any) (bool, any) {
+	switch x := v.(type) {
+	case nil:
+		return false, nil
+	case bool:
+		return x, nil
+	case float64:
+		return x != 0, nil
+	case string:
+		switch strings.ToUpper(x) {
+		case "TRUE":
+			return true, nil
+		case "FALSE":
+			return false, nil
+		}
+	case CellError:
+		return false, x
+	}
+	return false, ErrValue
+}
+
+// compareValues orders numbers before text before booleans; text compares
+// case-insensitively and a blank compares as the zero value of the other side.
+func compareValues(a, b any) int {
+	rank := func(v any) int {
+		switch v.(type) {
+		case float64:
+			return 0
+		case string:
+			return 1
+		case bool:
+			return 2
+		}
+		return -1
+	}
+	if a == nil {
+		a = zeroLike(b)
+	}
+	if b == nil {
+		b = zeroLike(a)
+	}
+	if ra, rb := rank(a), rank(b); ra != rb {
+		return ra - rb
+	}
+	switch x := a.(type) {
+	case float64:
+		y := b.(float64)
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	case string:
+		return strings.Compare(strings.ToLower(x), strings.ToLower(b.(string)))
+	case bool:
+		y := b.(bool)
+		switch {
+		case x == y:
+			return 0
+		case !x:
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
+
+func zeroLike(v any) any {
+	switch v.(type) {
+	case string:
+		return ""
+	case bool:
+		return false
+	}
+	return 0.0
+}
+
+// formatGeneral renders a number the way the General format does: up to 15
+// significant digits, no trailing zeros.
+func formatGeneral(f float64) string {
+	return strings.ToUpper(strconv.FormatFloat(f, 'g', 15, 64))
+}
+
+func displayText(v any) string {
+	if v == nil {
+		return ""
+	}
+	s, errVal := toText(v)
+	if errVal != nil {
+		return fmt.Sprint(errVal)
+	}
+	return s
+}
+
+// ---------- functions ----------
+
+// formulaFunc receives its arguments unevaluated so that each function can
+// decide how ranges, references and errors are treated, and so IF and
+// IFERROR only evaluate the branch they need.
+type formulaFunc func(ctx *evalCtx, args []expr) any
+
+type funcSpec struct {
+	minArgs, maxArgs int // maxArgs < 0 means variadic
+	fn               formulaFunc
+}
+
+func (f funcSpec) arity() string {
+	switch {
+	case f.maxArgs < 0:
+		return fmt.Sprintf("at least %d", f.minArgs)
+	case f.minArgs == f.maxArgs:
+		return strconv.Itoa(f.minArgs)
+	}
+	return fmt.Sprintf("%d to %d", f.minArgs, f.maxArgs)
+}
+
+var formulaFuncs map[string]funcSpec
+
+func init() {
+	formulaFuncs = map[string]funcSpec{
+		"SUM":     {1, -1, fnSum},
+		"AVERAGE": {1, -1, fnAverage},
+		"MIN":     {1, -1, fnMin},
+		"MAX":     {1, -1, fnMax},
+		"COUNT":   {1, -1, fnCount},
+
+		"IF":      {2, 3, fnIf},
+		"AND":     {1, -1, fnAnd},
+		"OR":      {1, -1, fnOr},
+		"NOT":     {1, 1, fnNot},
+		"IFERROR": {2, 2, fnIfError},
+		"ISERROR": {1, 1, fnIsError},
+		"ISNA":    {1, 1, fnIsNA},
+		"NA":      {0, 0, fnNA},
+
+		"LEN":    {1, 1, fnLen},
+		"UPPER":  {1, 1, fnUpper},
+		"LOWER":  {1, 1, fnLower},
+		"LEFT":   {1, 2, fnLeft},
+		"RIGHT":  {1, 2, fnRight},
+		"MID":    {3, 3, fnMid},
+		"CONCAT": {1, -1, fnConcat},
+		"TEXT":   {2, 2, fnText},
+
+		"DATE":    {3, 3, fnDate},
+		"TODAY":   {0, 0, fnToday},
+		"YEAR":    {1, 1, fnYear},
+		"MONTH":   {1, 1, fnMonth},
+		"DAY":     {1, 1, fnDay},
+		"DATEDIF": {3, 3, fnDatedif},
+
+		"VLOOKUP": {3, 4, fnVlookup},
+		"HLOOKUP": {3, 4, fnHlookup},
+		"MATCH":   {2, 3, fnMatch},
+		"INDEX":   {2, 3, fnIndex},
+		"XLOOKUP": {3, 6, fnXlookup},
+	}
+}
+
+// volatileFuncs are recomputed on every recalc, since their result changes
+// without any cell changing.
+var volatileFuncs = map[string]bool{"TODAY": true}
+
+// deref replaces a defined name by its definition, so a name for a range
+// is read as that range.
+func (ctx *evalCtx) deref(e expr) expr {
+	for {
+		n, ok := e.(nameExpr)
+		if !ok {
+			return e
+		}
+		def, ok := ctx.sh.names[string(n)]
+		if !ok {
+			return e
+		}
+		e = def.ast
+	}
+}
+
+// eachValue feeds fn every value an argument list stands for, expanding
+// ranges cell by cell. direct is false for values read from ranges and
+// references, which aggregates treat more leniently than literal arguments.
+func (ctx *evalCtx) eachValue(args []expr, fn func(v any, direct bool)) {
+	for _, a := range args {
+		switch a := ctx.deref(a).(type) {
+		case rangeExpr:
+			sh := ctx.sh.resolve(a.sheet)
+			if sh == nil {
+				fn(ErrRef, false)
+				continue
+			}
+			sh.eachInRange(a.g, func(v any) { fn(v, false) })
+		case refExpr:
+			fn(a.eval(ctx), false)
+		default:
+			fn(a.eval(ctx), true)
+		}
+	}
+}
+
+// numbers feeds fn the numeric inputs of an aggregate with spreadsheet
+// semantics: ranges and references contribute only their numeric cells, so
+// blanks, text and booleans are skipped, while direct arguments are coerced
+// and must convert. The first error value found is returned.
+func (ctx *evalCtx) numbers(args []expr, fn func(float64)) any {
+	var errVal any
+	ctx.eachValue(args, func(v any, direct bool) {
+		if errVal != nil {
+			return
+		}
+		if isErrorValue(v) {
+			errVal = v
+			return
+		}
+		if f, ok := v.(float64); ok {
+			fn(f)
+		} else if direct {
+			f, errVal = toNumber(v)
+			if errVal == nil {
+				fn(f)
+			}
+		}
+	})
+	return errVal
+}
+
+func fnSum(ctx *evalCtx, args []expr) any {
+	total := 0.0
+	if e := ctx.numbers(args, func(f float64) { total += f }); e != nil {
+		return e
+	}
+	return finite(total)
+}
+
+func fnAverage(ctx *evalCtx, args []expr) any {
+	total, n := 0.0, 0
+	if e := ctx.numbers(args, func(f float64) { total += f; n++ }); e != nil {
+		return e
+	}
+	if n == 0 {
+		return ErrDiv0
+	}
+	return finite(total / float64(n))
+}
+
+func fnMin(ctx *evalCtx, args []expr) any {
+	best, n := 0.0, 0
+	if e := ctx.numbers(args, func(f float64) {
+		if n == 0 || f < best {
+			best = f
+		}
+		n++
+	}); e != nil {
+		return e
+	}
+	return best
+}
+
+func fnMax(ctx *evalCtx, args []expr) any {
+	best, n := 0.0, 0
+	if e := ctx.numbers(args, func(f float64) {
+		if n == 0 || f > best {
+			best = f
+		}
+		n++
+	}); e != nil {
+		return e
+	}
+	return best
+}
+
+// COUNT never fails: it counts numbers (and direct arguments that convert
+// to one) and ignores everything else, including errors.
+func fnCount(ctx *evalCtx, args []expr) any {
+	n := 0
+	ctx.eachValue(args, func(v any, direct bool) {
+		if _, ok := v.(float64); ok {
+			n++
+		} else if _, errVal := toNumber(v); direct && v != nil && errVal == nil {
+			n++
+		}
+	})
+	return float64(n)
+}
+
+// ---------- logical functions ----------
+
+func fnIf(ctx *evalCtx, args []expr) any {
+	cond, errVal := toBool(args[0].eval(ctx))
+	if errVal != nil {
+		return errVal
+	}
+	switch {
+	case cond:
+		return args[1].eval(ctx)
+	case len(args) == 3:
+		return args[2].eval(ctx)
+	}
+	return false
+}
+
+// logical folds AND/OR arguments; text and blanks inside ranges are ignored,
+// and a call with no logical values at all is #VALUE!.
+func logical(ctx *evalCtx, args []expr, fold func(acc, b bool) bool, start bool) any {
+	acc, seen := start, false
+	var errVal any
+	ctx.eachValue(args, func(v any, direct bool) {
+		if errVal != nil {
+			return
+		}
+		if isErrorValue(v) {
+			errVal = v
+			return
+		}
+		if _, isText := v.(string); !direct && (v == nil || isText) {
+			return
+		}
+		b, e := toBool(v)
+		if e != nil {
+			errVal = e
+			return
+		}
+		acc, seen = fold(acc, b), true
+	})
+	if errVal != nil {
+		return errVal
+	}
+	if !seen {
+		return ErrValue
+	}
+	return acc
+}
+
+func fnAnd(ctx *evalCtx, args []expr) any {
+	return logical(ctx, args, func(acc, b bool) bool { return acc && b }, true)
+}
+
+func fnOr(ctx *evalCtx, args []expr) any {
+	return logical(ctx, args, func(acc, b bool) bool { return acc || b }, false)
+}
+
+func fnNot(ctx *evalCtx, args []expr) any {
+	b, errVal := toBool(args[0].eval(ctx))
+	if errVal != nil {
+		return errVal
+	}
+	return !b
+}
+
+func fnIfError(ctx *evalCtx, args []expr) any {
+	if v := args[0].eval(ctx); !isErrorValue(v) {
+		return v
+	}
+	return args[1].eval(ctx)
+}
+
+func fnIsError(ctx *evalCtx, args []expr) any { return isErrorValue(args[0].eval(ctx)) }
+func fnIsNA(ctx *evalCtx, args []expr) any    { return args[0].eval(ctx) == ErrNA }
+func fnNA(*evalCtx, []expr) any               { return ErrNA }
+
+// ---------- text functions ----------
+
+func textArg(ctx *evalCtx, e expr) (string, any) { return toText(e.eval(ctx)) }
+
+// countArg reads an optional character count, defaulting to def. Counts
+// beyond any text's length are capped so they convert to int safely.
+func countArg(ctx *evalCtx, args []expr, i int, def float64) (int, any) {
+	if i >= len(args) {
+		return int(def), nil
+	}
+	n, errVal := toNumber(args[i].eval(ctx))
+	if errVal != nil {
+		return 0, errVal
+	}
+	if n < 0 || math.IsNaN(n) {
+		return 0, ErrValue
+	}
+	return int(min(n, math.MaxInt32)), nil
+}
+
+func fnLen(ctx *evalCtx, args []expr) any {
+	s, errVal := textArg(ctx, args[0])
+	if errVal != nil {
+		return errVal
+	}
+	return float64(len([]rune(s)))
+}
+
+func fnUpper(ctx *evalCtx, args []expr) any {
+	s, errVal := textArg(ctx, args[0])
+	if errVal != nil {
+		return errVal
+	}
+	return strings.ToUpper(s)
+}
+
+func fnLower(ctx *evalCtx, args []expr) any {
+	s, errVal := textArg(ctx, args[0])
+	if errVal != nil {
+		return errVal
+	}
+	return strings.ToLower(s)
+}
+
+func fnLeft(ctx *evalCtx, args []expr) any {
+	s, errVal := textArg(ctx, args[0])
+	if errVal != nil {
+		return errVal
+	}
+	n, errVal := countArg(ctx, args, 1, 1)
+	if errVal != nil {
+		return errVal
+	}
+	r := []rune(s)
+	return string(r[:min(n, len(r))])
+}
+
+func fnRight(ctx *evalCtx, args []expr) any {
+	s, errVal := textArg(ctx, args[0])
+	if errVal != nil {
+		return errVal
+	}
+	n, errVal := countArg(ctx, args, 1, 1)
+	if errVal != nil {
+		return errVal
+	}
+	r := []rune(s)
+	return string(r[len(r)-min(n, len(r)):])
+}
+
+func fnMid(ctx *evalCtx, args []expr) any {
+	s, errVal := textArg(ctx, args[0])
+	if errVal != nil {
+		return errVal
+	}
+	start, errVal := countArg(ctx, args, 1, 1)
+	if errVal != nil {
+		return errVal
+	}
+	n, errVal := countArg(ctx, args, 2, 0)
+	if errVal != nil {
+		return errVal
+	}
+	if start < 1 {
+		return ErrValue
+	}
+	r := []rune(s)
+	from := min(start-1, len(r))
+	return string(r[from : from+min(n, len(r)-from)])
+}
+
+func fnConcat(ctx *evalCtx, args []expr) any {
+	var sb strings.Builder
+	var errVal any
+	ctx.eachValue(args, func(v any, _ bool) {
+		if errVal != nil {
+			return
+		}
+		s, e := toText(v)
+		if e != nil {
+			errVal = e
+			return
+		}
+		sb.WriteString(s)
+	})
+	if errVal != nil {
+		return errVal
+	}
+	return sb.String()
+}
+
+func fnText(ctx *evalCtx, args []expr) any {
+	v := args[0].eval(ctx)
+	pattern, errVal := textArg(ctx, args[1])
+	if errVal != nil {
+		return errVal
+	}
+	f, errVal := toNumber(v)
+	if errVal != nil {
+		if s, ok := v.(string); ok {
+			return s // TEXT leaves non-numeric text alone
+		}
+		return errVal
+	}
+	if g, section := formatSection(f, pattern); isDateFormat(section) && !dateInRange(g) {
+		return ErrNum
+	}
+	return formatNumber(f, pattern)
+}
+
+// formatNumber applies a number format such as "0", "0.00", "#,##0.00",
+// "0%" or "$#,##0", or a date format such as "yyyy-mm-dd" (see formatDate).
+// Up to three sections split by ";" format positive, negative and zero
+// values; a negative section supplies its own sign, as in "0;(0)". Literal
+// text around the digit placeholders is kept, quoted or not; an empty or
+// "General" pattern falls back to formatGeneral. A date out of range shows
+// as ##### the way spreadsheets show it.
+func formatNumber(f float64, pattern string) string {
+	if pattern == "" || strings.EqualFold(pattern, "General") {
+		return formatGeneral(f)
+	}
+	f, pattern = formatSection(f, pattern)
+	if isDateFormat(pattern) {
+		if !dateInRange(f) {
+			return "#####"
+		}
+		return formatDate(f, pattern)
+	}
+	start, end := -1, -1
+	scanFormat(pattern, func(i int) {
+		if pattern[i] == '0' || pattern[i] == '#' {
+			if start < 0 {
+				start = i
+			}
+			end = i + 1
+		}
+	})
+	if start < 0 {
+		return unquoteFormat(pattern)
+	}
+	prefix, body, suffix := unquoteFormat(pattern[:start]), pattern[start:end], unquoteFormat(pattern[end:])
+	if strings.Contains(suffix, "%") || strings.Contains(prefix, "%") {
+		f *= 100
+	}
+
+	intPart, fracPart, _ := strings.Cut(body, ".")
+	grouping := strings.Contains(intPart, ",")
+	minInt := strings.Count(intPart, "0")
+	decimals := len(fracPart)
+
+	neg := f < 0
+	digits := strconv.FormatFloat(math.Abs(f), 'f', decimals, 64)
+	whole, frac, _ := strings.Cut(digits, ".")
+	whole = strings.TrimLeft(whole, "0")
+	for len(whole) < minInt {
+		whole = "0" + whole
+	}
+	if grouping && len(whole) > 3 {
+		var sb strings.Builder
+		for i, r := range whole {
+			if i > 0 && (len(whole)-i)%3 == 0 {
+				sb.WriteByte(',')
+			}
+			sb.WriteRune(r)
+		}
+		whole = sb.String()
+	}
+	if optional := strings.Count(fracPart, "#"); optional > 0 {
+		frac = strings.TrimRight(frac, "0")
+		for len(frac) < decimals-optional {
+			frac += "0"
+		}
+	}
+	out := whole
+	if frac != "" {
+		out += "." + frac
+	}
+	if neg && strings.Trim(out, "0.,") != "" {
+		prefix = "-" + prefix
+	}
+	return prefix + out + suffix
+}
+
+// scanFormat calls fn with the index of every format code in pattern,
+// skipping quoted text and characters escaped with a backslash.
+func scanFormat(pattern string, fn func(i int)) {
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '"':
+			if j := strings.IndexByte(pattern[i+1:], '"'); j >= 0 {
+				i += j + 1
+			} else {
+				i = len(pattern)
+			}
+		case '\\':
+			i++
+		default:
+			fn(i)
+		}
+	}
+}
+
+// splitFormat splits a pattern into its ";" sections.
+func splitFormat(pattern string) []string {
+	var sections []string
+	last := 0
+	scanFormat(pattern, func(i int) {
+		if pattern[i] == ';' {
+			sections = append(sections, pattern[last:i])
+			last = i + 1
+		}
+	})
+	return append(sections, pattern[last:])
+}
+
+// unquoteFormat drops the quotes and escapes from the literal text of a
+// pattern.
+func unquoteFormat(s string) string {
+	if !strings.ContainsAny(s, `"\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				b.WriteByte(s[i])
+			}
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// ---------- dates ----------
+//
+// Dates are serial numbers as in spreadsheets: whole days since 1899-12-30,
+// so 1 is 1899-12-31 and 45366 is 2024-03-15, with the time of day as the
+// fraction. Serials before 1900-03-01 differ by a day from Excel, which
+// counts a 29 February 1900 that never was.
+
+var serialEpoch = time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+
+// maxDateSerial is 9999-12-31, the last date spreadsheets handle.
+const maxDateSerial = 2958465
+
+// dateInRange reports whether serial falls on a day from 1899-12-30 to
+// 9999-12-31, which serialTime converts without overflowing.
+func dateInRange(serial float64) bool { return serial >= 0 && serial < maxDateSerial+1 }
+
+// now is the clock TODAY reads.
+var now = time.Now
+
+func dateSerial(t time.Time) float64 {
+	return float64(t.Unix()-serialEpoch.Unix()) / 86400
+}
+
+func serialTime(serial float64) time.Time {
+	return time.Unix(serialEpoch.Unix()+int64(math.Round(serial*86400)), 0).UTC()
+}
+
+// dateLayouts are the inputs typed into a cell that are read as dates or
+// times, each with the format the cell then shows by default.
+var dateLayouts = []struct{ layout, format string }{
+	{"2006-01-02", "yyyy-mm-dd"},
+	{"2006-01-02 15:04", "yyyy-mm-dd hh:mm"},
+	{"2006-01-02 15:04:05", "yyyy-mm-dd hh:mm:ss"},
+	{"15:04", "hh:mm"},
+	{"15:04:05", "hh:mm:ss"},
+}
+
+func parseDateLiteral(s string) (serial float64, format string, ok bool) {
+	for _, l := range dateLayouts {
+		if t, err := time.Parse(l.layout, s); err == nil {
+			if t.Year() == 0 { // a time alone
+				return float64(t.Hour()*3600+t.Minute()*60+t.Second()) / 86400, l.format, true
+			}
+			return dateSerial(t), l.format, true
+		}
+	}
+	return 0, "", false
+}
+
+// dateArg reads a serial date argument; serials that are negative or past
+// 9999-12-31 are #NUM!.
+func dateArg(ctx *evalCtx, e expr) (time.Time, any) {
+	f, errVal := toNumber(e.eval(ctx))
+	if errVal != nil {
+		return time.Time{}, errVal
+	}
+	if !dateInRange(f) {
+		return time.Time{}, ErrNum
+	}
+	return serialTime(math.Floor(f)), nil
+}
+
+// fnDate builds a date from year, month and day, carrying overflowing
+// months and days over as spreadsheets do, so DATE(2024,14,1) is
+// 2025-02-01. Years below 1900 count from 1900.
+func fnDate(ctx *evalCtx, args []expr) any {
+	var parts [3]int
+	for i, a := range args {
+		f, errVal := toNumber(a.eval(ctx))
+		if errVal != nil {
+			return errVal
+		}
+		parts[i] = int(math.Floor(f))
+	}
+	year := parts[0]
+	if year < 1900 {
+		year += 1900
+	}
+	if year < 0 {
+		return ErrNum
+	}
+	serial := dateSerial(time.Date(year, time.Month(parts[1]), parts[2], 0, 0, 0, 0, time.UTC))
+	if serial < 0 {
+		return ErrNum
+	}
+	return serial
+}
+
+func fnToday(*evalCtx, []expr) any {
+	y, m, d := now().Date()
+	return dateSerial(time.Date(y, m, d, 0, 0, 0, 0, time.UTC))
+}
+
+func fnYear(ctx *evalCtx, args []expr) any {
+	t, errVal := dateArg(ctx, args[0])
+	if errVal != nil {
+		return errVal
+	}
+	return float64(t.Year())
+}
+
+func fnMonth(ctx *evalCtx, args []expr) any {
+	t, errVal := dateArg(ctx, args[0])
+	if errVal != nil {
+		return errVal
+	}
+	return float64(t.Month())
+}
+
+func fnDay(ctx *evalCtx, args []expr) any {
+	t, errVal := dateArg(ctx, args[0])
+	if errVal != nil {
+		return errVal
+	}
+	return float64(t.Day())
+}
+
+// fnDatedif counts the whole units between two dates: "Y" years, "M"
+// months, "D" days, and "YM", "MD" and "YD" for the months, days and days
+// left over once years, months, or years are taken out.
+func fnDatedif(ctx *evalCtx, args []expr) any {
+	start, errVal := dateArg(ctx, args[0])
+	if errVal != nil {
+		return errVal
+	}
+	end, errVal := dateArg(ctx, args[1])
+	if errVal != nil {
+		return errVal
+	}
+	unit, errVal := textArg(ctx, args[2])
+	if errVal != nil {
+		return errVal
+	}
+	if end.Before(start) {
+		return ErrNum
+	}
+	months := (end.Year()-start.Year())*12 + int(end.Month()-start.Month())
+	if end.Day() < start.Day() {
+		months--
+	}
+	switch strings.ToUpper(unit) {
+	case "Y":
+		return float64(months / 12)
+	case "M":
+		return float64(months)
+	case "D":
+		return math.Round(end.Sub(start).Hours() / 24)
+	case "YM":
+		return float64(months % 12)
+	case "MD":
+		if end.Day() >= start.Day() {
+			return float64(end.Day() - start.Day())
+		}
+		// days from start's day in the month before end's month, or from
+		// that month's end when it is shorter
+		prev := time.Date(end.Year(), end.Month(), 0, 0, 0, 0, 0, time.UTC)
+		return float64(prev.Day() - min(start.Day(), prev.Day()) + end.Day())
+	case "YD":
+		anniversary := time.Date(end.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.UTC)
+		if anniversary.After(end) {
+			anniversary = anniversary.AddDate(-1, 0, 0)
+		}
+		return math.Round(end.Sub(anniversary).Hours() / 24)
+	}
+	return ErrNum
+}
+
+// formatSection picks the section of a number format that applies to f,
+// along with the value it formats.
+func formatSection(f float64, pattern string) (float64, string) {
+	sections := splitFormat(pattern)
+	switch {
+	case f < 0 && len(sections) > 1:
+		return -f, sections[1]
+	case f == 0 && len(sections) > 2:
+		return f, sections[2]
+	}
+	return f, sections[0]
+}
+
+// isDateFormat reports whether a number format shows a date or time: it
+// has date or time codes and no digit placeholders, quoted text aside.
+func isDateFormat(pattern string) bool {
+	hasCode, hasDigits := false, false
+	scanFormat(pattern, func(i int) {
+		switch ch := pattern[i]; {
+		case ch == '0' || ch == '#':
+			hasDigits = true
+		case strings.IndexByte("ymdhsYMDHS", ch) >= 0:
+			hasCode = true
+		}
+	})
+	return hasCode && !hasDigits
+}
+
+type dateToken struct {
+	code byte // y, m (month), n (minute), d, h, s, a (AM/PM), or 0 for literal text
+	n    int
+	text string
+}
+
+// formatDate renders a serial with codes yyyy, yy, mmmm, mmm, mm, m, dddd,
+// ddd, dd, d, hh, h, mm and m for minutes after an hour or before seconds,
+// ss, s and AM/PM, in any case; quoted and backslashed text is copied.
+func formatDate(serial float64, pattern string) string {
+	var toks []dateToken
+	for i := 0; i < len(pattern); {
+		ch := pattern[i]
+		lower := ch | 0x20
+		switch {
+		case ch == '"':
+			j := strings.IndexByte(pattern[i+1:], '"')
+			if j < 0 {
+				j = len(pattern) - i - 1
+			}
+			toks = append(toks, dateToken{text: pattern[i+1 : i+1+j]})
+			i += j + 2
+		case ch == '\\' && i+1 < len(pattern):
+			toks = append(toks, dateToken{text: pattern[i+1 : i+2]})
+			i += 2
+		case strings.HasPrefix(strings.ToUpper(pattern[i:]), "AM/PM"):
+			toks = append(toks, dateToken{code: 'a'})
+			i += 5
+		case strings.IndexByte("ymdhs", lower) >= 0:
+			j := i
+			for j < len(pattern) && pattern[j]|0x20 == lower {
+				j++
+			}
+			toks = append(toks, dateToken{code: lower, n: j - i})
+			i = j
+		default:
+			toks = append(toks, dateToken{text: pattern[i : i+1]})
+			i++
+		}
+	}
+
+	twelveHour := false
+	prev := byte(0)
+	for i := range toks {
+		switch toks[i].code {
+		case 0:
+			continue
+		case 'a':
+			twelveHour = true
+		case 'm':
+			next := byte(0)
+			for _, t := range toks[i+1:] {
+				if t.code != 0 {
+					next = t.code
+					break
+				}
+			}
+			if prev == 'h' || next == 's' {
+				toks[i].code = 'n'
+			}
+		}
+		prev = toks[i].code
+	}
+
+	t := serialTime(serial)
+	num := func(v, n int) string {
+		if n >= 2 {
+			return fmt.Sprintf("%02d", v)
+		}
+		return strconv.Itoa(v)
+	}
+	var b strings.Builder
+	for _, tok := range toks {
+		switch tok.code {
+		case 0:
+			b.WriteString(tok.text)
+		case 'y':
+			if tok.n <= 2 {
+				b.WriteString(fmt.Sprintf("%02d", t.Year()%100))
+			} else {
+				b.WriteString(fmt.Sprintf("%04d", t.Year()))
+			}
+		case 'm':
+			switch {
+			case tok.n == 3:
+				b.WriteString(t.Month().String()[:3])
+			case tok.n > 3:
+				b.WriteString(t.Month().String())
+			default:
+				b.WriteString(num(int(t.Month()), tok.n))
+			}
+		case 'd':
+			switch {
+			case tok.n == 3:
+				b.WriteString(t.Weekday().String()[:3])
+			case tok.n > 3:
+				b.WriteString(t.Weekday().String())
+			default:
+				b.WriteString(num(t.Day(), tok.n))
+			}
+		case 'h':
+			h := t.Hour()
+			if twelveHour {
+				if h = h % 12; h == 0 {
+					h = 12
+				}
+			}
+			b.WriteString(num(h, tok.n))
+		case 'n':
+			b.WriteString(num(t.Minute(), tok.n))
+		case 's':
+			b.WriteString(num(t.Second(), tok.n))
+		case 'a':
+			if t.Hour() < 12 {
+				b.WriteString("AM")
+			} else {
+				b.WriteString("PM")
+			}
+		}
+	}
+	return b.String()
+}
+
+// ---------- lookup functions ----------
+//
+// Lookups read their tables as whole ranges, so a formula such as
+// =VLOOKUP(A1,Prices!A2:C500,3,FALSE) depends on every cell of the table
+// and is recomputed when any of them changes, not just the one it found.
+// Matching compares like with like: numbers with numbers, text with text
+// ignoring case, logicals with logicals; blank cells never match.
+
+// lookupRange reads a range argument of a lookup; a single reference
+// counts as a one-cell range.
+func (ctx *evalCtx) lookupRange(e expr) (*Sheet, cellRange, any) {
+	switch a := ctx.deref(e).(type) {
+	case rangeExpr:
+		if sh := ctx.sh.resolve(a.sheet); sh != nil {
+			return sh, a.g, nil
+		}
+		return nil, cellRange{}, ErrRef
+	case refExpr:
+		if sh := ctx.sh.resolve(a.sheet); sh != nil {
+			row, col := splitRef(a.ref)
+			return sh, cellRange{row, col, row, col}, nil
+		}
+		return nil, cellRange{}, ErrRef
+	default:
+		if v := a.eval(ctx); isErrorValue(v) {
+			return nil, cellRange{}, v
+		}
+	}
+	return nil, cellRange{}, ErrValue
+}
+
+// lookupVector is one row or column of a range.
+type lookupVector struct {
+	sh *Sheet
+	g  cellRange
+}
+
+// vector returns g as a vector, or false when it is more than one row
+// tall and one column wide.
+func vector(sh *Sheet, g cellRange) (lookupVector, bool) {
+	return lookupVector{sh, g}, g.r1 == g.r2 || g.c1 == g.c2
+}
+
+func (v lookupVector) len() int {
+	if v.g.r1 == v.g.r2 {
+		return v.g.c2 - v.g.c1 + 1
+	}
+	return v.g.r2 - v.g.r1 + 1
+}
+
+// at reads the i'th cell, counting from 0.
+func (v lookupVector) at(i int) any {
+	if v.g.r1 == v.g.r2 {
+		return v.sh.valueAt(cellName(v.g.r1, v.g.c1+i))
+	}
+	return v.sh.valueAt(cellName(v.g.r1+i, v.g.c1))
+}
+
+// sameKind reports whether a lookup may compare a and b.
+func sameKind(a, b any) bool {
+	switch a.(type) {
+	case float64:
+		_, ok := b.(float64)
+		return ok
+	case string:
+		_, ok := b.(string)
+		return ok
+	case bool:
+		_, ok := b.(bool)
+		return ok
+	}
+	return false
+}
+
+// find returns the index in vec of want, or -1. mode 0 wants the first
+// exact match; 1 wants the last value not above want and -1 the last not
+// below it, reading vec as sorted ascending or descending respectively, as
+// MATCH's match_type does. The sorted search stops at the first value past
+// want.
+func (vec lookupVector) find(want any, mode int) int {
+	found := -1
+	for i := range vec.len() {
+		v := vec.at(i)
+		if !sameKind(v, want) {
+			continue
+		}
+		order := compareValues(v, want)
+		switch {
+		case order == 0:
+			if mode == 0 {
+				return i
+			}
+			found = i
+		case mode == 0:
+		case order*mode < 0:
+			found = i
+		default:
+			return found
+		}
+	}
+	if mode == 0 {
+		return -1
+	}
+	return found
+}
+
+// nearest is XLOOKUP's search: an exact match, or failing that with mode
+// -1 the next smaller value and with mode 1 the next larger one, anywhere
+// in vec. reverse searches from the end, which decides between equal
+// candidates.
+func (vec lookupVector) nearest(want any, mode int, reverse bool) int {
+	n := vec.len()
+	best := -1
+	for k := range n {
+		i := k
+		if reverse {
+			i = n - 1 - k
+		}
+		v := vec.at(i)
+		if !sameKind(v, want) {
+			continue
+		}
+		order := compareValues(v, want)
+		switch {
+		case order == 0:
+			return i
+		case mode == 0 || order*mode < 0:
+		case best < 0 || compareValues(v, vec.at(best))*mode < 0:
+			best = i
+		}
+	}
+	return best
+}
+
+// lookupValue evaluates the value a lookup searches for. Errors propagate
+// and a blank finds nothing.
+func lookupValue(ctx *evalCtx, e expr) any {
+	v := e.eval(ctx)
+	if v == nil {
+		return ErrNA
+	}
+	return v
+}
+
+// intArg reads an optional whole-number argument, defaulting to def.
+func intArg(ctx *evalCtx, args []expr, i int, def int) (int, any) {
+	if i >= len(args) {
+		return def, nil
+	}
+	f, errVal := toNumber(args[i].eval(ctx))
+	if errVal != nil {
+		return 0, errVal
+	}
+	return int(f), nil
+}
+
+func fnVlookup(ctx *evalCtx, args []expr) any { return tableLookup(ctx, args, true) }
+func fnHlookup(ctx *evalCtx, args []expr) any { return tableLookup(ctx, args, false) }
+
+// tableLookup is VLOOKUP, which finds a value in the first column of a
+// table and returns the same row of another column, and HLOOKUP, which
+// does the same across rows. The match is approximate unless the fourth
+// argument is FALSE: the last key not above the value, in a table sorted
+// by its keys.
+func tableLookup(ctx *evalCtx, args []expr, vertical bool) any {
+	want := lookupValue(ctx, args[0])
+	if isErrorValue(want) {
+		return want
+	}
+	sh, g, errVal := ctx.lookupRange(args[1])
+	if errVal != nil {
+		return errVal
+	}
+	index, errVal := intArg(ctx, args, 2, 0)
+	if errVal != nil {
+		return errVal
+	}
+	approx := true
+	if len(args) > 3 {
+		if approx, errVal = toBool(args[3].eval(ctx)); errVal != nil {
+			return errVal
+		}
+	}
+
+	keys, width := cellRange{g.r1, g.c1, g.r2, g.c1}, g.c2-g.c1+1
+	if !vertical {
+		keys, width = cellRange{g.r1, g.c1, g.r1, g.c2}, g.r2-g.r1+1
+	}
+	switch {
+	case index < 1:
+		return ErrValue
+	case index > width:
+		return ErrRef
+	}
+	mode := 0
+	if approx {
+		mode = 1
+	}
+	i := lookupVector{sh, keys}.find(want, mode)
+	switch {
+	case i < 0:
+		return ErrNA
+	case vertical:
+		return blankAsZero(sh.valueAt(cellName(g.r1+i, g.c1+index-1)))
+	}
+	return blankAsZero(sh.valueAt(cellName(g.r1+index-1, g.c1+i)))
+}
+
+// blankAsZero is how a formula shows a blank cell it returns.
+func blankAsZero(v any) any {
+	if v == nil {
+		return 0.0
+	}
+	return v
+}
+
+// fnMatch returns the 1-based position of a value in a row or column;
+// match_type is 1 (the default), 0 or -1 as described at find.
+func fnMatch(ctx *evalCtx, args []expr) any {
+	want := lookupValue(ctx, args[0])
+	if isErrorValue(want) {
+		return want
+	}
+	sh, g, errVal := ctx.lookupRange(args[1])
+	if errVal != nil {
+		return errVal
+	}
+	mode, errVal := intArg(ctx, args, 2, 1)
+	if errVal != nil {
+		return errVal
+	}
+	vec, ok := vector(sh, g)
+	if !ok {
+		return ErrNA
+	}
+	if i := vec.find(want, max(-1, min(mode, 1))); i >= 0 {
+		return float64(i + 1)
+	}
+	return ErrNA
+}
+
+// fnIndex returns the cell at a 1-based row and column of a range; a
+// single row or column needs only one position.
+func fnIndex(ctx *evalCtx, args []expr) any {
+	sh, g, errVal := ctx.lookupRange(args[0])
+	if errVal != nil {
+		return errVal
+	}
+	row, errVal := intArg(ctx, args, 1, 0)
+	if errVal != nil {
+		return errVal
+	}
+	col, errVal := intArg(ctx, args, 2, 0)
+	if errVal != nil {
+		return errVal
+	}
+	if len(args) == 2 {
+		switch {
+		case g.c1 == g.c2:
+			col = 1
+		case g.r1 == g.r2:
+			row, col = 1, row // INDEX(A1:F1, 3) counts along the row
+		}
+	}
+	switch {
+	case row < 0 || col < 0:
+		return ErrValue
+	case row == 0 || col == 0:
+		return ErrValue // a whole row or column is a range, not a value
+	case row > g.r2-g.r1+1 || col > g.c2-g.c1+1:
+		return ErrRef
+	}
+	return blankAsZero(sh.valueAt(cellName(g.r1+row-1, g.c1+col-1)))
+}
+
+// fnXlookup finds a value in one row or column and returns the same
+// position of another of the same length. The optional arguments are the
+// result when nothing matches (#N/A by default), the match mode (0 exact,
+// -1 exact or next smaller, 1 exact or next larger) and the search mode (1
+// from the first, -1 from the last).
+func fnXlookup(ctx *evalCtx, args []expr) any {
+	want := lookupValue(ctx, args[0])
+	if isErrorValue(want) {
+		return want
+	}
+	sh, g, errVal := ctx.lookupRange(args[1])
+	if errVal != nil {
+		return errVal
+	}
+	rsh, rg, errVal := ctx.lookupRange(args[2])
+	if errVal != nil {
+		return errVal
+	}
+	mode, errVal := intArg(ctx, args, 4, 0)
+	if errVal != nil {
+		return errVal
+	}
+	search, errVal := intArg(ctx, args, 5, 1)
+	if errVal != nil {
+		return errVal
+	}
+	keys, ok := vector(sh, g)
+	results, rok := vector(rsh, rg)
+	switch {
+	case !ok || !rok || keys.len() != results.len():
+		return ErrValue
+	case mode < -1 || mode > 1 || search != 1 && search != -1:
+		return ErrValue
+	}
+	if i := keys.nearest(want, mode, search < 0); i >= 0 {
+		return blankAsZero(results.at(i))
+	}
+	if len(args) > 3 {
+		return args[3].eval(ctx)
+	}
+	return ErrNA
+}
+
+// ---------- CSV ----------
+
+// CSVMode picks what ExportCSV writes for formula cells.
+type CSVMode int
+
+const (
+	CSVValues   CSVMode = iota // evaluated values, without number formats
+	CSVFormulas                // raw input, so formulas survive a round trip
+)
+
+// ImportCSV writes the records of r into the sheet with the first field at
+// origin. Fields that parse as numbers or dates become numbers, fields
+// starting with "=" become formulas, a leading apostrophe marks the rest as
+// text (as ExportCSV writes it), and everything else is stored as text even
+// when it looks like TRUE or #N/A. Empty fields clear existing cells and
+// are skipped otherwise. The whole import is recalculated once at the end.
+func (sh *Sheet) ImportCSV(r io.Reader, origin string) error {
+	origin = strings.ToUpper(strings.TrimSpace(origin))
+	if !cellRefRe.MatchString(origin) {
+		return fmt.Errorf("invalid origin: %s", origin)
+	}
+	row0, col0 := splitRef(origin)
+
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+
+	sh.wb.mu.Lock()
+	defer sh.wb.unlock()
+	if sh.deleted {
+		return fmt.Errorf("sheet %q was deleted", sh.name)
+	}
+	defer sh.wb.recalc()
+	defer sh.wb.track()()
+
+	for row := row0; ; row++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return sh.wb.refuseCycle()
+		}
+		if err != nil {
+			return errors.Join(err, sh.wb.refuseCycle())
+		}
+		for i, field := range rec {
+			ref := cellName(row, col0+i)
+			if strings.TrimSpace(field) == "" {
+				if _, exists := sh.grid[ref]; exists {
+					sh.assign(ref, "")
+				}
+				continue
+			}
+			sh.assign(ref, csvFieldRaw(field))
+		}
+	}
+}
+
+func csvFieldRaw(field string) string {
+	trimmed := strings.TrimSpace(field)
+	if _, err := strconv.ParseFloat(trimmed, 64); err == nil || strings.HasPrefix(trimmed, "=") || strings.HasPrefix(trimmed, "'") {
+		return trimmed
+	}
+	if _, _, ok := parseDateLiteral(trimmed); ok {
+		return trimmed
+	}
+	return textRaw(trimmed)
+}
+
+// textRaw is the input that makes a cell hold exactly text.
+func textRaw(text string) string {
+	if v, ok := literalValue(text).(string); ok && v == text && !strings.HasPrefix(text, "=") {
+		return text
+	}
+	return "'" + text
+}
+
+// ExportCSV writes the rectangle rng (for example "A1:D20"), or the used
+// range when rng is empty, one record per row. Rows are streamed, so a very
+// wide or tall range never needs to fit in memory as a whole.
+func (sh *Sheet) ExportCSV(w io.Writer, rng string, mode CSVMode) error {
+	sh.wb.mu.RLock()
+	defer sh.wb.mu.RUnlock()
+
+	var g cellRange
+	if rng == "" {
+		var ok bool
+		if g, ok = sh.usedRange(); !ok {
+			return nil
+		}
+	} else {
+		var err error
+		if g, err = parseRange(rng); err != nil {
+			return err
+		}
+	}
+
+	cw := csv.NewWriter(w)
+	rec := make([]string, g.c2-g.c1+1)
+	for r := g.r1; r <= g.r2; r++ {
+		for c := g.c1; c <= g.c2; c++ {
+			rec[c-g.c1] = ""
+			cl, ok := sh.grid[cellName(r, c)]
+			switch {
+			case !ok:
+			case mode == CSVValues:
+				rec[c-g.c1] = displayText(cl.val)
+			case cl.ast == nil && cl.parseErr == nil:
+				// literal text goes out bare only if ImportCSV reads it back
+				// as that same text
+				if text, isText := cl.val.(string); isText && csvFieldRaw(text) == textRaw(text) {
+					rec[c-g.c1] = text
+					break
+				}
+				fallthrough
+			default:
+				rec[c-g.c1] = cl.raw
+			}
+		}
+		if err := cw.Write(rec); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// usedRange is the bounding box of the non-blank cells.
+func (sh *Sheet) usedRange() (cellRange, bool) {
+	g, found := cellRange{}, false
+	for ref, c := range sh.grid {
+		if c.raw == "" {
+			continue
+		}
+		row, col := splitRef(ref)
+		if !found {
+			g, found = cellRange{row, col, row, col}, true
+			continue
+		}
+		g = cellRange{min(g.r1, row), min(g.c1, col), max(g.r2, row), max(g.c2, col)}
+	}
+	return g, found
+}
+
+// ---------- XLSX ----------
+//
+// Only the parts of Office Open XML that carry cell contents are handled:
+// the workbook and its worksheets, shared strings, inline strings, and
+// formulas with their cached results. Styles, merged cells and the like are
+// ignored on read and not written.
+
+// NamedSheet is one worksheet of an XLSX file. Sheets that belong to a
+// Workbook are better written with Workbook.WriteXLSX, which keeps their
+// names in step with the references in their formulas.
+type NamedSheet struct {
+	Name  string
+	Sheet *Sheet
+}
+
+const (
+	xlsxMainNS = "http://schemas.openxmlformats.org/spreadsheetml/2006/main"
+	xlsxRelNS  = "http://schemas.openxmlformats.org/officeDocument/2006/relationships"
+	xlsxPkgNS  = "http://schemas.openxmlformats.org/package/2006/relationships"
+	xlsxDocRel = "http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument"
+)
+
+var xlsxBadSheetName = regexp.MustCompile(`[\[\]:*?/\\]`)
+
+// xlsxErrors are the error values a cell may hold in OOXML; Excel reports a
+// file with any other one as corrupt, so the rest are written as text.
+var xlsxErrors = map[CellError]bool{ErrRef: true, ErrValue: true, ErrName: true, ErrDiv0: true, ErrNA: true, ErrNum: true}
+
+func validSheetName(name string) error {
+	if name == "" || len([]rune(name)) > 31 || xlsxBadSheetName.MatchString(name) {
+		return fmt.Errorf("invalid sheet name %q", name)
+	}
+	return nil
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// WriteXLSX writes the sheets, in order, as a workbook. Formula cells keep
+// their cached values and the workbook asks the reader to recalculate on
+// open. Formulas that do not parse are written as their text.
+func WriteXLSX(w io.Writer, sheets []NamedSheet) error {
+	if len(sheets) == 0 {
+		return errors.New("xlsx: need at least one sheet")
+	}
+	seen := map[string]bool{}
+	for _, ns := range sheets {
+		if err := validSheetName(ns.Name); err != nil {
+			return err
+		}
+		if seen[strings.ToLower(ns.Name)] {
+			return fmt.Errorf("duplicate sheet name %q", ns.Name)
+		}
+		seen[strings.ToLower(ns.Name)] = true
+	}
+
+	zw := zip.NewWriter(w)
+	part := func(name, body string) error {
+		f, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(f, xml.Header+body)
+		return err
+	}
+
+	var ct, wb, rels strings.Builder
+	ct.WriteString(`<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/sharedStrings.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sharedStrings+xml"/>`)
+	fmt.Fprintf(&wb, `<workbook xmlns="%s" xmlns:r="%s"><sheets>`, xlsxMainNS, xlsxRelNS)
+	fmt.Fprintf(&rels, `<Relationships xmlns="%s">`, xlsxPkgNS)
+	for i, ns := range sheets {
+		n := i + 1
+		fmt.Fprintf(&ct, `<Override PartName="/xl/worksheets/sheet%d.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`, n)
+		fmt.Fprintf(&wb, `<sheet name="%s" sheetId="%d" r:id="rId%d"/>`, xmlEscape(ns.Name), n, n)
+		fmt.Fprintf(&rels, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet%d.xml"/>`, n, n)
+	}
+	ct.WriteString(`</Types>`)
+	wb.WriteString(`</sheets><calcPr fullCalcOnLoad="1"/></workbook>`)
+	fmt.Fprintf(&rels, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/sharedStrings" Target="sharedStrings.xml"/></Relationships>`, len(sheets)+1)
+
+	if err := part("[Content_Types].xml", ct.String()); err != nil {
+		return err
+	}
+	if err := part("_rels/.rels", fmt.Sprintf(`<Relationships xmlns="%s"><Relationship Id="rId1" Type="%s" Target="xl/workbook.xml"/></Relationships>`, xlsxPkgNS, xlsxDocRel)); err != nil {
+		return err
+	}
+	if err := part("xl/workbook.xml", wb.String()); err != nil {
+		return err
+	}
+	if err := part("xl/_rels/workbook.xml.rels", rels.String()); err != nil {
+		return err
+	}
+
+	strs := &sharedStrings{index: map[string]int{}}
+	for i, ns := range sheets {
+		f, err := zw.Create(fmt.Sprintf("xl/worksheets/sheet%d.xml", i+1))
+		if err != nil {
+			return err
+		}
+		if err := ns.Sheet.writeWorksheet(f, strs); err != nil {
+			return err
+		}
+	}
+
+	var sst strings.Builder
+	fmt.Fprintf(&sst, `<sst xmlns="%s" count="%d" uniqueCount="%d">`, xlsxMainNS, len(strs.list), len(strs.list))
+	for _, s := range strs.list {
+		fmt.Fprintf(&sst, `<si><t xml:space="preserve">%s</t></si>`, xmlEscape(s))
+	}
+	sst.WriteString(`</sst>`)
+	if err := part("xl/sharedStrings.xml", sst.String()); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// WriteXLSX writes the workbook's sheets under their own names.
+func (wb *Workbook) WriteXLSX(w io.Writer) error {
+	var sheets []NamedSheet
+	for _, sh := range wb.Sheets() {
+		sheets = append(sheets, NamedSheet{Name: sh.Name(), Sheet: sh})
+	}
+	return WriteXLSX(w, sheets)
+}
+
+type sharedStrings struct {
+	index map[string]int
+	list  []string
+}
+
+func (s *sharedStrings) id(text string) int {
+	if i, ok := s.index[text]; ok {
+		return i
+	}
+	s.index[text] = len(s.list)
+	s.list = append(s.list, text)
+	return len(s.list) - 1
+}
+
+func (sh *Sheet) writeWorksheet(w io.Writer, strs *sharedStrings) error {
+	sh.wb.mu.RLock()
+	defer sh.wb.mu.RUnlock()
+
+	type pos struct {
+		row, col int
+		ref      string
+	}
+	var cells []pos
+	for ref, c := range sh.grid {
+		if c.raw != "" {
+			row, col := splitRef(ref)
+			cells = append(cells, pos{row, col, ref})
+		}
+	}
+	sort.Slice(cells, func(i, j int) bool {
+		if cells[i].row != cells[j].row {
+			return cells[i].row < cells[j].row
+		}
+		return cells[i].col < cells[j].col
+	})
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, `%s<worksheet xmlns="%s"><sheetData>`, xml.Header, xlsxMainNS)
+	for i, p := range cells {
+		if i == 0 || cells[i-1].row != p.row {
+			if i > 0 {
+				bw.WriteString(`</row>`)
+			}
+			fmt.Fprintf(bw, `<row r="%d">`, p.row)
+		}
+		c := sh.grid[p.ref]
+		formula, val := "", c.val
+		switch {
+		case c.ast != nil:
+			formula = fmt.Sprintf(`<f>%s</f>`, xmlEscape(c.raw[1:]))
+		case c.parseErr != nil:
+			val = c.raw // Excel refuses files with malformed formulas
+		}
+		if e, isErr := val.(CellError); isErr && !xlsxErrors[e] {
+			val = string(e) // such as #CIRCULAR!
+		}
+		switch v := val.(type) {
+		case float64:
+			fmt.Fprintf(bw, `<c r="%s">%s<v>%s</v></c>`, p.ref, formula, strconv.FormatFloat(v, 'g', -1, 64))
+		case bool:
+			b := 0
+			if v {
+				b = 1
+			}
+			fmt.Fprintf(bw, `<c r="%s" t="b">%s<v>%d</v></c>`, p.ref, formula, b)
+		case CellError:
+			fmt.Fprintf(bw, `<c r="%s" t="e">%s<v>%s</v></c>`, p.ref, formula, xmlEscape(string(v)))
+		case string:
+			if formula != "" {
+				fmt.Fprintf(bw, `<c r="%s" t="str">%s<v>%s</v></c>`, p.ref, formula, xmlEscape(v))
+			} else {
+				fmt.Fprintf(bw, `<c r="%s" t="s"><v>%d</v></c>`, p.ref, strs.id(v))
+			}
+		default:
+			fmt.Fprintf(bw, `<c r="%s">%s</c>`, p.ref, formula)
+		}
+	}
+	if len(cells) > 0 {
+		bw.WriteString(`</row>`)
+	}
+	bw.WriteString(`</sheetData></worksheet>`)
+	return bw.Flush()
+}
+
+type xlsxRels struct {
+	Rels []struct {
+		ID     string `xml:"Id,attr"`
+		Type   string `xml:"Type,attr"`
+		Target string `xml:"Target,attr"`
+	} `xml:"Relationship"`
+}
+
+type xlsxWorkbook struct {
+	Sheets []struct {
+		Name string `xml:"name,attr"`
+		RID  string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+	} `xml:"sheets>sheet"`
+}
+
+// xlsxRichText covers both plain <t> and runs of <r><t>.
+type xlsxRichText struct {
+	T    string `xml:"t"`
+	Runs []struct {
+		T string `xml:"t"`
+	} `xml:"r"`
+}
+
+func (t xlsxRichText) text() string {
+	if len(t.Runs) == 0 {
+		return t.T
+	}
+	var b strings.Builder
+	for _, r := range t.Runs {
+		b.WriteString(r.T)
+	}
+	return b.String()
+}
+
+type xlsxWorksheet struct {
+	Rows []struct {
+		R     int `xml:"r,attr"`
+		Cells []struct {
+			R  string        `xml:"r,attr"`
+			T  string        `xml:"t,attr"`
+			F  *string       `xml:"f"`
+			V  *string       `xml:"v"`
+			IS *xlsxRichText `xml:"is"`
+		} `xml:"c"`
+	} `xml:"sheetData>row"`
+}
+
+// ReadXLSX loads every worksheet of the file in r into a Workbook.
+// Formulas come in as formulas, cross-sheet references included, and are
+// recalculated once all sheets are loaded; followers of a shared formula
+// carry no formula text of their own and fall back to their cached value.
+func ReadXLSX(r io.ReaderAt, size int64) (*Workbook, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]*zip.File, len(zr.File))
+	for _, f := range zr.File {
+		files[strings.TrimPrefix(f.Name, "/")] = f
+	}
+	decode := func(name string, v any) error {
+		f, ok := files[name]
+		if !ok {
+			return fmt.Errorf("xlsx: missing part %s", name)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		return xml.NewDecoder(rc).Decode(v)
+	}
+	resolve := func(base, target string) string {
+		if strings.HasPrefix(target, "/") {
+			return strings.TrimPrefix(target, "/")
+		}
+		return path.Join(path.Dir(base), target)
+	}
+
+	wbPath := "xl/workbook.xml"
+	var pkg xlsxRels
+	if decode("_rels/.rels", &pkg) == nil {
+		for _, rel := range pkg.Rels {
+			if rel.Type == xlsxDocRel {
+				wbPath = resolve("", rel.Target)
+			}
+		}
+	}
+	var wb xlsxWorkbook
+	if err := decode(wbPath, &wb); err != nil {
+		return nil, err
+	}
+	relsPath := path.Join(path.Dir(wbPath), "_rels", path.Base(wbPath)+".rels")
+	var wbRels xlsxRels
+	if err := decode(relsPath, &wbRels); err != nil {
+		return nil, err
+	}
+	targets := map[string]string{}
+	var shared []string
+	for _, rel := range wbRels.Rels {
+		targets[rel.ID] = resolve(wbPath, rel.Target)
+		if strings.HasSuffix(rel.Type, "/sharedStrings") {
+			var sst struct {
+				SI []xlsxRichText `xml:"si"`
+			}
+			if err := decode(resolve(wbPath, rel.Target), &sst); err != nil {
+				return nil, err
+			}
+			for _, si := range sst.SI {
+				shared = append(shared, si.text())
+			}
+		}
+	}
+
+	// Every sheet exists before any formula is linked, so references to
+	// later sheets resolve.
+	book := NewWorkbook()
+	for _, s := range wb.Sheets {
+		if err := validSheetName(s.Name); err != nil {
+			return nil, err
+		}
+		if book.lookup(s.Name) != nil {
+			return nil, fmt.Errorf("duplicate sheet name %q", s.Name)
+		}
+		book.newSheet(s.Name)
+	}
+	for i, s := range wb.Sheets {
+		var ws xlsxWorksheet
+		if err := decode(targets[s.RID], &ws); err != nil {
+			return nil, fmt.Errorf("sheet %q: %w", s.Name, err)
+		}
+		if err := book.sheets[i].loadXLSX(&ws, shared); err != nil {
+			return nil, fmt.Errorf("sheet %q: %w", s.Name, err)
+		}
+	}
+	book.recalc()
+	return book, nil
+}
+
+// loadXLSX fills a sheet that is not shared yet, so it takes no lock and
+// leaves the recalculation to the caller.
+func (sh *Sheet) loadXLSX(ws *xlsxWorksheet, shared []string) error {
+	row := 0
+	for _, rw := range ws.Rows {
+		if row = rw.R; row == 0 {
+			row++ // rows without r follow the previous one
+		}
+		col := 0
+		for _, c := range rw.Cells {
+			ref := strings.ToUpper(c.R)
+			if ref == "" {
+				col++
+				ref = cellName(row, col)
+			} else if !cellRefRe.MatchString(ref) {
+				return fmt.Errorf("bad cell reference %q", c.R)
+			} else {
+				row, col = splitRef(ref)
+				ref = cellName(row, col)
+			}
+
+			if c.F != nil && *c.F != "" {
+				sh.assign(ref, "="+*c.F)
+				continue
+			}
+			v := ""
+			if c.V != nil {
+				v = *c.V
+			}
+			switch c.T {
+			case "s":
+				i, err := strconv.Atoi(v)
+				if err != nil || i < 0 || i >= len(shared) {
+					return fmt.Errorf("%s: bad shared string index %q", ref, v)
+				}
+				sh.assign(ref, textRaw(shared[i]))
+			case "inlineStr":
+				if c.IS != nil {
+					sh.assign(ref, textRaw(c.IS.text()))
+				}
+			case "str":
+				sh.assign(ref, textRaw(v))
+			case "d":
+				sh.assign(ref, xlsxDateRaw(v))
+			case "b":
+				sh.assign(ref, map[bool]string{true: "TRUE", false: "FALSE"}[v == "1"])
+			case "e":
+				sh.assign(ref, v)
+			default:
+				if v != "" {
+					sh.assign(ref, v)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// xlsxDateRaw turns an ISO 8601 date cell into the input that enters that
+// date; dates it cannot read stay text.
+func xlsxDateRaw(v string) string {
+	v = strings.TrimSuffix(v, "Z")
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.Parse(layout, v); err == nil {
+			if t.Hour() == 0 && t.Minute() == 0 && t.Second() == 0 {
+				return t.Format("2006-01-02")
+			}
+			return t.Format("2006-01-02 15:04:05")
+		}
+	}
+	return textRaw(v)
+}
+
+// ---------- JSON documents ----------
+//
+// A document is the input of every cell rather than its value, so loading
+// one recalculates from scratch:
+//
+//	{
+//	  "version": 1,
+//	  "sheets": [
+//	    {
+//	      "name": "Budget",
+//	      "cells": [
+//	        {"ref": "A1", "input": "2024-03-15", "format": "d mmm yyyy"},
+//	        {"ref": "B1", "input": "=SUM(Revenue)*TaxRate"}
+//	      ],
+//	      "names": {"REVENUE": "B2:B13", "TAXRATE": "0.2"}
+//	    }
+//	  ]
+//	}
+//
+// Cells are listed row by row and names by name, so saving the same sheet
+// twice gives the same bytes.
+
+// docVersion is the document version Save writes.
+const docVersion = 1
+
+// docMigrations upgrade a document from version v to v+1, keyed by v. They
+// work on the decoded JSON tree rather than on jsonDoc, which only ever
+// describes the current version. A change to the format bumps docVersion
+// and adds the step from the previous version here.
+var docMigrations = map[int]func(doc map[string]any) error{}
+
+type jsonDoc struct {
+	Version int         `json:"version"`
+	Sheets  []jsonSheet `json:"sheets"`
+}
+
+type jsonSheet struct {
+	Name  string            `json:"name"`
+	Cells []jsonCell        `json:"cells"`
+	Names map[string]string `json:"names,omitempty"`
+}
+
+type jsonCell struct {
+	Ref    string `json:"ref"`
+	Input  string `json:"input,omitempty"`
+	Format string `json:"format,omitempty"`
+}
+
+// Save writes the sheet as a one-sheet document. References to other
+// sheets of its workbook are saved as written; use Workbook.Save to keep
+// the sheets they read.
+func (sh *Sheet) Save(w io.Writer) error {
+	sh.wb.mu.RLock()
+	doc := jsonDoc{docVersion, []jsonSheet{sh.doc()}}
+	sh.wb.mu.RUnlock()
+	return writeDoc(w, doc)
+}
+
+// Save writes every sheet of the workbook, in order, as one document.
+func (wb *Workbook) Save(w io.Writer) error {
+	wb.mu.RLock()
+	doc := jsonDoc{Version: docVersion}
+	for _, sh := range wb.sheets {
+		doc.Sheets = append(doc.Sheets, sh.doc())
+	}
+	wb.mu.RUnlock()
+	return writeDoc(w, doc)
+}
+
+func writeDoc(w io.Writer, doc jsonDoc) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
+
+// doc captures the sheet's inputs, formats and names. Callers hold the
+// read lock.
+func (sh *Sheet) doc() jsonSheet {
+	s := jsonSheet{Name: sh.name, Cells: []jsonCell{}}
+	for ref, c := range sh.grid {
+		if c.raw != "" || c.format != "" {
+			s.Cells = append(s.Cells, jsonCell{ref, c.raw, c.format})
+		}
+	}
+	sort.Slice(s.Cells, func(i, j int) bool {
+		ri, ci := splitRef(s.Cells[i].Ref)
+		rj, cj := splitRef(s.Cells[j].Ref)
+		return ri < rj || ri == rj && ci < cj
+	})
+	if len(sh.names) > 0 {
+		s.Names = make(map[string]string, len(sh.names))
+		for key, def := range sh.names {
+			s.Names[key] = strings.TrimPrefix(def.raw, "=")
+		}
+	}
+	return s
+}
+
+// Load replaces the contents of the sheet, names and formats included,
+// with the one sheet of a document written by Sheet.Save, and clears the
+// undo history. The sheet keeps its own name and its subscribers, who hear
+// about every value the load changed. On error, a *CycleError in strict
+// mode included, the sheet is left as it was.
+func (sh *Sheet) Load(r io.Reader) error {
+	doc, err := readDoc(r)
+	if err != nil {
+		return err
+	}
+	if len(doc.Sheets) != 1 {
+		return fmt.Errorf("document holds %d sheets, want 1", len(doc.Sheets))
+	}
+	s := &doc.Sheets[0]
+	if err := s.check(); err != nil {
+		return err
+	}
+
+	sh.wb.mu.Lock()
+	defer sh.wb.unlock()
+
+	if sh.deleted {
+		return fmt.Errorf("sheet %q was deleted", sh.name)
+	}
+	for ref := range sh.grid {
+		sh.wb.noteOld(cellKey{sh, ref})
+	}
+	grid, names, hist := sh.grid, sh.names, sh.wb.hist
+	sh.grid = make(map[string]*cell)
+	sh.names = make(map[string]*cell)
+	sh.wb.hist.clear()
+	sh.wb.relink() // drops every edge into the old cells
+	sh.load(s)
+	sh.wb.relink()
+	err = sh.wb.closedCycle()
+	if err != nil {
+		clear(sh.wb.pending) // the loaded cells
+		sh.grid, sh.names, sh.wb.hist = grid, names, hist
+		sh.wb.relink()
+	}
+	sh.wb.recalc()
+	return err
+}
+
+// LoadWorkbook reads a document written by Workbook.Save or Sheet.Save
+// into a new workbook, rebuilding the dependency graph and recalculating
+// every formula. A sheet saved without a name, as a standalone sheet is,
+// gets the first free name of the form Sheet1, Sheet2 and so on.
+func LoadWorkbook(r io.Reader) (*Workbook, error) {
+	doc, err := readDoc(r)
+	if err != nil {
+		return nil, err
+	}
+	taken := make(map[string]bool, len(doc.Sheets))
+	for _, s := range doc.Sheets {
+		taken[strings.ToUpper(s.Name)] = true
+	}
+	n := 0
+	for i := range doc.Sheets {
+		for doc.Sheets[i].Name == "" {
+			n++
+			if name := fmt.Sprintf("Sheet%d", n); !taken[strings.ToUpper(name)] {
+				doc.Sheets[i].Name = name
+			}
+		}
+	}
+
+	// Every sheet exists before any formula is linked, so references to
+	// later sheets resolve.
+	book := NewWorkbook()
+	for i := range doc.Sheets {
+		s := &doc.Sheets[i]
+		if err := validSheetName(s.Name); err != nil {
+			return nil, err
+		}
+		if book.lookup(s.Name) != nil {
+			return nil, fmt.Errorf("duplicate sheet name %q", s.Name)
+		}
+		if err := s.check(); err != nil {
+			return nil, fmt.Errorf("sheet %q: %w", s.Name, err)
+		}
+		book.newSheet(s.Name)
+	}
+	for i := range doc.Sheets {
+		book.sheets[i].load(&doc.Sheets[i])
+	}
+	book.relink()
+	book.recalc()
+	return book, nil
+}
+
+// readDoc decodes a document of any supported version, migrating older
+// ones to the current version first.
+func readDoc(r io.Reader) (*jsonDoc, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var head struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(data, &head); err != nil {
+		return nil, fmt.Errorf("document: %w", err)
+	}
+	switch {
+	case head.Version < 1:
+		return nil, errors.New("document: missing version")
+	case head.Version > docVersion:
+		return nil, fmt.Errorf("document version %d is newer than %d", head.Version, docVersion)
+	case head.Version < docVersion:
+		var tree map[string]any
+		if err := json.Unmarshal(data, &tree); err != nil {
+			return nil, fmt.Errorf("document: %w", err)
+		}
+		for v := head.Version; v < docVersion; v++ {
+			migrate, ok := docMigrations[v]
+			if !ok {
+				return nil, fmt.Errorf("document: no migration from version %d", v)
+			}
+			if err := migrate(tree); err != nil {
+				return nil, fmt.Errorf("document: migrating version %d: %w", v, err)
+			}
+			tree["version"] = v + 1
+		}
+		if data, err = json.Marshal(tree); err != nil {
+			return nil, err
+		}
+	}
+	doc := new(jsonDoc)
+	if err := json.Unmarshal(data, doc); err != nil {
+		return nil, fmt.Errorf("document: %w", err)
+	}
+	return doc, nil
+}
+
+// check validates a sheet of a document and puts its refs and names into
+// canonical form, so that load cannot fail halfway. Formulas that do not
+// parse are kept, as they are on entry.
+func (s *jsonSheet) check() error {
+	seen := make(map[string]bool, len(s.Cells))
+	for i, c := range s.Cells {
+		ref, ok := normRef(c.Ref)
+		if !ok {
+			return fmt.Errorf("invalid ref: %s", c.Ref)
+		}
+		if seen[ref] {
+			return fmt.Errorf("cell %s appears twice", ref)
+		}
+		seen[ref] = true
+		s.Cells[i].Ref = ref
+	}
+	names := make(map[string]string, len(s.Names))
+	for name, def := range s.Names {
+		key := strings.ToUpper(strings.TrimSpace(name))
+		if !definedNameRe.MatchString(key) || cellRefRe.MatchString(key) || key == "TRUE" || key == "FALSE" {
+			return fmt.Errorf("invalid name %q", name)
+		}
+		def = strings.TrimPrefix(strings.TrimSpace(def), "=")
+		if _, err := parseFormula(def); err != nil {
+			return fmt.Errorf("name %s: %w", key, err)
+		}
+		names[key] = def
+	}
+	scratch := &Sheet{names: make(map[string]*cell, len(names))}
+	for key, def := range names {
+		scratch.putName(key, "="+def)
+	}
+	for key, def := range scratch.names {
+		if scratch.nameReaches(key, def.ast) {
+			return fmt.Errorf("name %s refers to itself", key)
+		}
+	}
+	s.Names = names
+	return nil
+}
+
+// load fills the sheet from a checked document sheet. Callers hold the
+// write lock, or own a workbook nobody else can see yet, and relink and
+// recalculate afterwards.
+func (sh *Sheet) load(s *jsonSheet) {
+	for _, c := range s.Cells {
+		sh.assign(c.Ref, c.Input)
+		sh.grid[c.Ref].format = c.Format
+	}
+	for key, def := range s.Names {
+		sh.putName(key, "="+def)
+	}
+}
+
+// ---------- collaborative editing server ----------
+//
+// CollabServer lets several people edit one sheet over HTTP:
+//
+//	GET  /sheet     the sheet as a JSON document, with its revision
+//	GET  /events    server-sent events: edits, value changes and presence
+//	POST /edits     apply a CollabEdit
+//	POST /presence  move the caller's cursor
+//
+// Every accepted edit gets the next revision number, and clients say which
+// revision they had seen when they made an edit. An edit made before other
+// edits it had not seen is rebased past them: rows and columns inserted or
+// deleted since move its cell, its position and the references in its
+// formula as they moved everything else. Two edits to the same cell are
+// resolved last writer wins; the later one is applied and its result names
+// the revision it overwrote. An edit whose cell has been deleted since, or
+// that is older than the edit log kept, is refused with 409 Conflict.
+
+// collabLogLimit is how many accepted edits a CollabServer keeps for
+// rebasing; edits based on an older revision are refused.
+const collabLogLimit = 1000
+
+// CollabEdit is an edit as posted to /edits and as sent to every client.
+type CollabEdit struct {
+	Rev    uint64 `json:"rev,omitempty"` // assigned by the server
+	Base   uint64 `json:"base"`          // revision the client had seen
+	Client string `json:"client"`
+	Op     string `json:"op"` // set, insertRows, deleteRows, insertColumns or deleteColumns
+
+	Ref   string `json:"ref,omitempty"` // the cell and input of a set
+	Input string `json:"input,omitempty"`
+
+	At int `json:"at,omitempty"` // the first row or column and the count of the others
+	N  int `json:"n,omitempty"`
+}
+
+// CollabResult answers a POST to /edits.
+type CollabResult struct {
+	Edit      CollabEdit `json:"edit"`                // as applied, after rebasing
+	Overwrote uint64     `json:"overwrote,omitempty"` // the unseen edit of the same cell it replaced
+}
+
+// Presence is a connected client and the cell its cursor is on.
+type Presence struct {
+	Client string `json:"client"`
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// collabCell is a cell whose value an edit changed, as clients receive it.
+type collabCell struct {
+	Ref     string `json:"ref"`
+	Value   any    `json:"value"`
+	Display string `json:"display"`
+}
+
+type collabEvent struct {
+	name string
+	id   uint64 // the revision of an edit, 0 for other events
+	data []byte
+}
+
+type collabStream struct {
+	client string
+	ch     chan collabEvent
+}
+
+type collabPeer struct {
+	cursor  string
+	streams int
+}
+
+// CollabServer serves one sheet to many editors. While it does, the sheet
+// should only be edited through it, since rebasing relies on seeing every
+// row and column edit.
+type CollabServer struct {
+	sh          *Sheet
+	mux         *http.ServeMux
+	unsubscribe func()
+
+	edit sync.Mutex // serialises rebasing and applying edits
+
+	mu       sync.Mutex
+	rev      uint64
+	log      []CollabEdit      // the latest accepted edits, oldest first
+	written  map[string]uint64 // revision of the last set of each cell
+	applying bool              // an edit is in progress and gathers the changes
+	changed  []collabCell
+	streams  map[*collabStream]struct{}
+	peers    map[string]*collabPeer
+	closed   bool
+}
+
+func NewCollabServer(sh *Sheet) *CollabServer {
+	s := &CollabServer{
+		sh:      sh,
+		mux:     http.NewServeMux(),
+		written: make(map[string]uint64),
+		streams: make(map[*collabStream]struct{}),
+		peers:   make(map[string]*collabPeer),
+	}
+	s.mux.HandleFunc("GET /sheet", s.handleSheet)
+	s.mux.HandleFunc("GET /events", s.handleEvents)
+	s.mux.HandleFunc("POST /edits", s.handleEdit)
+	s.mux.HandleFunc("POST /presence", s.handlePresence)
+	s.unsubscribe, _ = sh.Subscribe("", s.cellsChanged)
+	return s
+}
+
+func (s *CollabServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Close ends every event stream and stops following the sheet.
+func (s *CollabServer) Close() {
+	s.unsubscribe()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for st := range s.streams {
+		close(st.ch)
+	}
+	clear(s.streams)
+	clear(s.peers)
+}
+
+// cellsChanged is the server's subscription to the sheet. Changes made by
+// an edit go out with it; any others go out at once.
+func (s *CollabServer) cellsChanged(changes []CellChange) {
+	cells := make([]collabCell, len(changes))
+	for i, ch := range changes {
+		display, _ := s.sh.Display(ch.Ref)
+		cells[i] = collabCell{ch.Ref, ch.New, display}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.applying {
+		s.changed = append(s.changed, cells...)
+		return
+	}
+	s.broadcast("values", 0, struct {
+		Rev   uint64       `json:"rev"`
+		Cells []collabCell `json:"cells"`
+	}{s.rev, cells})
+}
+
+// broadcast queues an event for every stream. A client too slow to keep up
+// is disconnected rather than allowed to hold the others back; it can
+// reload the sheet and reconnect. Callers hold s.mu.
+func (s *CollabServer) broadcast(name string, id uint64, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	for st := range s.streams {
+		select {
+		case st.ch <- collabEvent{name, id, data}:
+		default:
+			close(st.ch)
+			s.drop(st)
+		}
+	}
+}
+
+// drop forgets a stream. Callers hold s.mu.
+func (s *CollabServer) drop(st *collabStream) {
+	delete(s.streams, st)
+	if p := s.peers[st.client]; p != nil {
+		if p.streams--; p.streams == 0 {
+			delete(s.peers, st.client)
+		}
+	}
+}
+
+// presence returns the connected clients by name. Callers hold s.mu.
+func (s *CollabServer) presence() []Presence {
+	out := make([]Presence, 0, len(s.peers))
+	for client, p := range s.peers {
+		out = append(out, Presence{client, p.cursor})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Client < out[j].Client })
+	return out
+}
+
+func (s *CollabServer) handleSheet(w http.ResponseWriter, r *http.Request) {
+	// hold off edits so the document and the revision agree
+	s.edit.Lock()
+	var doc bytes.Buffer
+	err := s.sh.Save(&doc)
+	s.mu.Lock()
+	rev := s.rev
+	s.mu.Unlock()
+	s.edit.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, struct {
+		Rev      uint64          `json:"rev"`
+		Document json.RawMessage `json:"document"`
+	}{rev, doc.Bytes()})
+}
+
+// handleEvents streams events to one client, which names itself with the
+// client query parameter. It starts with a hello event carrying the
+// current revision; edit events carry their revision as the event id.
+func (s *CollabServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	client := strings.TrimSpace(r.URL.Query().Get("client"))
+	if client == "" {
+		http.Error(w, "missing client", http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	st := &collabStream{client: client, ch: make(chan collabEvent, 64)}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		http.Error(w, "server closed", http.StatusServiceUnavailable)
+		return
+	}
+	hello, _ := json.Marshal(struct {
+		Rev    uint64 `json:"rev"`
+		Client string `json:"client"`
+	}{s.rev, client})
+	st.ch <- collabEvent{"hello", 0, hello}
+	s.streams[st] = struct{}{}
+	if s.peers[client] == nil {
+		s.peers[client] = &collabPeer{}
+	}
+	s.peers[client].streams++
+	s.broadcast("presence", 0, s.presence())
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if _, open := s.streams[st]; open {
+			s.drop(st)
+			s.broadcast("presence", 0, s.presence())
+		}
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, open := <-st.ch:
+			if !open {
+				return
+			}
+			if ev.id > 0 {
+				fmt.Fprintf(w, "id: %d\n", ev.id)
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.name, ev.data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func (s *CollabServer) handleEdit(w http.ResponseWriter, r *http.Request) {
+	var e CollabEdit
+	if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	res, err := s.Apply(e)
+	switch {
+	case errors.Is(err, ErrEditConflict):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		writeJSON(w, res)
+	}
+}
+
+func (s *CollabServer) handlePresence(w http.ResponseWriter, r *http.Request) {
+	var p Presence
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if p.Cursor != "" {
+		ref, ok := normRef(p.Cursor)
+		if !ok {
+			http.Error(w, "invalid ref: "+p.Cursor, http.StatusBadRequest)
+			return
+		}
+		p.Cursor = ref
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peer := s.peers[strings.TrimSpace(p.Client)]
+	if peer == nil {
+		http.Error(w, "client not connected: "+p.Client, http.StatusNotFound)
+		return
+	}
+	peer.cursor = p.Cursor
+	s.broadcast("presence", 0, s.presence())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// ErrEditConflict is returned for edits that cannot be rebased.
+var ErrEditConflict = errors.New("edit conflict")
+
+// Apply rebases an edit onto the current revision, applies it and sends it
+// to every client, as a POST to /edits does.
+func (s *CollabServer) Apply(e CollabEdit) (CollabResult, error) {
+	e.Client = strings.TrimSpace(e.Client)
+	if e.Client == "" {
+		return CollabResult{}, errors.New("missing client")
+	}
+	shift, structural := e.shift()
+	switch {
+	case e.Op == "set":
+		ref, ok := normRef(e.Ref)
+		if !ok {
+			return CollabResult{}, fmt.Errorf("invalid ref: %s", e.Ref)
+		}
+		e.Ref = ref
+	case !structural:
+		return CollabResult{}, fmt.Errorf("unknown op %q", e.Op)
+	case e.At < 1 || e.N < 1:
+		return CollabResult{}, fmt.Errorf("invalid position %d or count %d", e.At, e.N)
+	}
+
+	s.edit.Lock()
+	defer s.edit.Unlock()
+
+	s.mu.Lock()
+	err := s.rebase(&e)
+	res := CollabResult{}
+	if err == nil && e.Op == "set" && s.written[e.Ref] > e.Base {
+		res.Overwrote = s.written[e.Ref]
+	}
+	s.applying = true
+	s.mu.Unlock()
+	if err != nil {
+		return CollabResult{}, err
+	}
+
+	if shift, structural = e.shift(); structural {
+		err = s.sh.shiftCells(shift, e.N)
+	} else {
+		err = s.sh.Set(e.Ref, e.Input)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cells := s.changed
+	s.applying, s.changed = false, nil
+	if err != nil {
+		return CollabResult{}, err
+	}
+	s.rev++
+	e.Rev = s.rev
+	s.log = append(s.log, e)
+	if over := len(s.log) - collabLogLimit; over > 0 {
+		s.log = slices.Delete(s.log, 0, over)
+	}
+	s.broadcast("edit", e.Rev, struct {
+		CollabEdit
+		Cells []collabCell `json:"cells"`
+	}{e, cells})
+	if structural {
+		s.followShift(shift)
+	} else {
+		s.written[e.Ref] = e.Rev
+	}
+	res.Edit = e
+	return res, nil
+}
+
+// shift is the row or column edit e makes, if it makes one.
+func (e CollabEdit) shift() (lineShift, bool) {
+	switch e.Op {
+	case "insertRows":
+		return lineShift{at: e.At, n: e.N}, true
+	case "deleteRows":
+		return lineShift{at: e.At, n: -e.N}, true
+	case "insertColumns":
+		return lineShift{cols: true, at: e.At, n: e.N}, true
+	case "deleteColumns":
+		return lineShift{cols: true, at: e.At, n: -e.N}, true
+	}
+	return lineShift{}, false
+}
+
+// rebase moves e past the row and column edits accepted after its base
+// revision. Callers hold s.mu.
+func (s *CollabServer) rebase(e *CollabEdit) error {
+	switch {
+	case e.Base > s.rev:
+		return fmt.Errorf("base revision %d is ahead of %d", e.Base, s.rev)
+	case len(s.log) > 0 && e.Base+1 < s.log[0].Rev:
+		return fmt.Errorf("%w: base revision %d is too old, reload the sheet", ErrEditConflict, e.Base)
+	}
+	for _, past := range s.log {
+		shift, ok := past.shift()
+		if past.Rev <= e.Base || !ok {
+			continue
+		}
+		mine, structural := e.shift()
+		switch {
+		case !structural:
+			ref, ok := shift.ref(e.Ref)
+			if !ok {
+				return fmt.Errorf("%w: %s was deleted at revision %d", ErrEditConflict, e.Ref, past.Rev)
+			}
+			e.Ref = ref
+			e.Input = shiftedRaw(e.Input, s.sh, shift)
+		case mine.cols != shift.cols:
+		case mine.n > 0:
+			// an insertion point inside a deleted block lands where it was
+			if at, ok := shift.index(e.At); ok {
+				e.At = at
+			} else {
+				e.At = shift.at
+			}
+		default:
+			lo, hi, ok := shift.span(e.At, e.At+e.N-1)
+			if !ok {
+				return fmt.Errorf("%w: the lines to delete were deleted at revision %d", ErrEditConflict, past.Rev)
+			}
+			e.At, e.N = lo, hi-lo+1
+		}
+	}
+	return nil
+}
+
+// followShift moves the per-cell revisions and the cursors along with the
+// cells. Callers hold s.mu.
+func (s *CollabServer) followShift(shift lineShift) {
+	written := make(map[string]uint64, len(s.written))
+	for ref, rev := range s.written {
+		if to, ok := shift.ref(ref); ok {
+			written[to] = rev
+		}
+	}
+	s.written = written
+	for _, p := range s.peers {
+		if p.cursor == "" {
+			continue
+		}
+		if to, ok := shift.ref(p.cursor); ok {
+			p.cursor = to
+		} else {
+			p.cursor = ""
+		}
+	}
+	s.broadcast("presence", 0, s.presence())
+}
+
+// shiftedRaw is the input raw, meant for sh, rewritten for cells moved by
+// shift: its references to sh follow their cells.
+func shiftedRaw(raw string, sh *Sheet, shift lineShift) string {
+	if !strings.HasPrefix(raw, "=") {
+		return raw
+	}
+	ast, err := parseFormula(raw[1:])
+	if err != nil {
+		return raw
+	}
+	rewrite := shift.rewriter(sh)
+	if ast, changed := mapRefs(ast, func(e expr) (expr, bool) { return rewrite(sh, e) }); changed {
+		return "=" + formatExpr(ast)
+	}
+	return raw
+}
+
+// runCollab serves a sheet, empty or loaded from a JSON document, for
+// collaborative editing:
+//
+//	go run 05-excel-cell.go serve 127.0.0.1:8080 [sheet.json]
+func runCollab(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("usage: serve <addr> [sheet.json]")
+	}
+	sh := NewSheet()
+	if len(args) == 2 {
+		f, err := os.Open(args[1])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := sh.Load(f); err != nil {
+			return err
+		}
+	}
+	ln, err := net.Listen("tcp", args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Println("serving the sheet on http://" + ln.Addr().String())
+	return http.Serve(ln, NewCollabServer(sh))
+}
+
+// runTUI opens the terminal viewer on an empty sheet, or on a CSV file.
+func runTUI(args []string) error {
+	sh := NewSheet()
+	if len(args) > 1 {
+		return errors.New("usage: tui [file.csv]")
+	}
+	if len(args) == 1 {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := sh.ImportCSV(f, "A1"); err != nil {
+			return err
+		}
+	}
+	return sh.RunTUI()
+}
+
+// ---------- self-checks ----------
+//
+// The check subcommand runs these and exits non-zero if any fails; run it
+// under the race detector to catch unsynchronized access as well:
+//
+//	go run -race 05-excel-cell.go check
+
+var selfChecks = []struct {
+	name string
+	run  func() error
+}{
+	{"concurrent reads during recalculation", checkConcurrentRecalc},
+	{"csv round trip", checkCSVRoundTrip},
+	{"unnamed sheet document", checkUnnamedSheetDoc},
+	{"strict calculation", checkStrictCalc},
+	{"collaborative editing", checkCollab},
+	{"xlsx error values", checkXLSXErrors},
+	{"date functions", checkDates},
+	{"text functions", checkTextCounts},
+	{"arithmetic out of range", checkArithmeticRange},
+}
+
+func runChecks() error {
+	failed := 0
+	for _, c := range selfChecks {
+		if err := c.run(); err != nil {
+			fmt.Printf("FAIL %s: %v\n", c.name, err)
+			failed++
+			continue
+		}
+		fmt.Println("ok  ", c.name)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(selfChecks))
+	}
+	return nil
+}
+
+// checkConcurrentRecalc reads a sheet from several goroutines while another
+// one edits and recalculates it. The formulas form waves of hundreds of
+// cells, so recalc evaluates them in parallel; every value read must be one
+// that some complete recalculation produced, and the final values must
+// match a sheet built one cell at a time, whose waves are evaluated
+// serially.
+func checkConcurrentRecalc() error {
+	const rows, edits = 300, 50
+	build := func(sh *Sheet, a1 int) {
+		_ = sh.Set("A1", strconv.Itoa(a1))
+		for r := 2; r <= rows; r++ {
+			_ = sh.Set(cellName(r, 1), fmt.Sprintf("=A1*%d", r))
+		}
+		for r := 1; r <= rows; r++ {
+			_ = sh.Set(cellName(r, 2), fmt.Sprintf("=A%d-A1", r))
+		}
+		_ = sh.Set("C1", fmt.Sprintf("=SUM(B1:B%d)", rows))
+	}
+	sh := NewSheet()
+	build(sh, 1)
+
+	// each value must be its row's multiple of some A1 from 1 to edits
+	multiple := func(v any, of float64) bool {
+		f, ok := v.(float64)
+		k := f / of
+		return ok && k == math.Trunc(k) && k >= 1 && k <= edits
+	}
+	stop := make(chan struct{})
+	errs := make(chan error, 4)
+	var wg sync.WaitGroup
+	for w := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := w; ; i++ {
+				select {
+				case <-stop:
+					errs <- nil
+					return
+				default:
+				}
+				r := i%(rows-1) + 2
+				a, _ := sh.Get(cellName(r, 1))
+				b, _ := sh.Get(cellName(r, 2))
+				c, _ := sh.Get("C1")
+				if !multiple(a, float64(r)) || !multiple(b, float64(r-1)) || !multiple(c, rows*(rows-1)/2) {
+					errs <- fmt.Errorf("read A%d=%v B%d=%v C1=%v mid-recalculation", r, a, r, b, c)
+					return
+				}
+			}
+		}()
+	}
+	for k := 2; k <= edits; k++ {
+		_ = sh.Set("A1", strconv.Itoa(k))
+		if k%10 == 0 {
+			sh.Recalculate()
+		}
+	}
+	close(stop)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	serial := NewSheet()
+	build(serial, edits)
+	for r := 1; r <= rows; r++ {
+		for c := 1; c <= 3; c++ {
+			ref := cellName(r, c)
+			want, _ := serial.Get(ref)
+			got, _ := sh.Get(ref)
+			if got != want {
+				return fmt.Errorf("%s = %v, want %v as evaluated serially", ref, got, want)
+			}
+		}
+	}
+	return nil
+}
+
+// checkCSVRoundTrip exports formulas and text that could be misread as
+// something else, and expects ImportCSV to give back the same values.
+func checkCSVRoundTrip() error {
+	inputs := []string{
+		"'007", "'2024-03-15", "'  padded", "'14:30", "'TRUE", "'#N/A",
+		"'=1+1", "''quoted", "plain text", "7", "2024-03-15", "=A1&B1",
+	}
+	src := NewSheet()
+	for i, raw := range inputs {
+		_ = src.Set(cellName(1, i+1), raw)
+	}
+	var buf bytes.Buffer
+	if err := src.ExportCSV(&buf, "", CSVFormulas); err != nil {
+		return err
+	}
+	dst := NewSheet()
+	if err := dst.ImportCSV(bytes.NewReader(buf.Bytes()), "A1"); err != nil {
+		return err
+	}
+	for i := range inputs {
+		ref := cellName(1, i+1)
+		want, _ := src.Get(ref)
+		got, _ := dst.Get(ref)
+		if got != want {
+			return fmt.Errorf("%s: %#v came back as %#v from %q", ref, want, got, strings.TrimSpace(buf.String()))
+		}
+	}
+	return nil
+}
+
+// checkUnnamedSheetDoc loads what Sheet.Save writes for a standalone sheet
+// as a workbook, next to a sheet that already uses the first default name.
+func checkUnnamedSheetDoc() error {
+	sh := NewSheet()
+	_ = sh.Set("A1", "2")
+	_ = sh.Set("A2", "=A1*21")
+	var buf bytes.Buffer
+	if err := sh.Save(&buf); err != nil {
+		return err
+	}
+	book, err := LoadWorkbook(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		return err
+	}
+	if v, _ := book.Sheet("Sheet1").Get("A2"); v != 42.0 {
+		return fmt.Errorf("Sheet1!A2 = %v, want 42", v)
+	}
+
+	doc := strings.Replace(buf.String(), `"sheets": [`, `"sheets": [{"name": "sheet1", "cells": []},`, 1)
+	if book, err = LoadWorkbook(strings.NewReader(doc)); err != nil {
+		return err
+	}
+	if names := []string{book.Sheets()[0].Name(), book.Sheets()[1].Name()}; names[1] != "Sheet2" {
+		return fmt.Errorf("sheets named %q, want the unnamed one to be Sheet2", names)
+	}
+	return nil
+}
+
+// checkStrictCalc closes a cycle in every way other than Set and expects
+// each edit to be refused with the workbook left as it was.
+func checkStrictCalc() error {
+	strict := func(sh *Sheet, inputs ...string) *Sheet {
+		for i := 0; i < len(inputs); i += 2 {
+			_ = sh.Set(inputs[i], inputs[i+1])
+		}
+		if err := sh.SetCalcOptions(CalcOptions{Strict: true}); err != nil {
+			panic(err)
+		}
+		return sh
+	}
+	refused := func(what string, sh *Sheet, err error, ref, input string) error {
+		var cycle *CycleError
+		switch {
+		case !errors.As(err, &cycle):
+			return fmt.Errorf("%s: got %v, want a cycle error", what, err)
+		case len(sh.DetectCycles()) > 0:
+			return fmt.Errorf("%s: left cycles %v", what, sh.DetectCycles())
+		case sh.Input(ref) != input:
+			return fmt.Errorf("%s: %s holds %q, want %q", what, ref, sh.Input(ref), input)
+		}
+		return nil
+	}
+
+	sh := strict(NewSheet(), "P1", "=Q1", "R1", "=$P$1")
+	if err := refused("copy", sh, sh.Copy("R1", "Q1"), "Q1", ""); err != nil {
+		return err
+	}
+	sh = strict(NewSheet(), "A1", "=$A$3")
+	if err := refused("fill", sh, sh.FillDown("A1:A3"), "A3", ""); err != nil {
+		return err
+	}
+	sh = strict(NewSheet(), "B1", "=Loop+1")
+	if err := refused("name", sh, sh.DefineName("Loop", "B1"), "B1", "=Loop+1"); err != nil {
+		return err
+	}
+	sh = strict(NewSheet())
+	err := sh.ImportCSV(strings.NewReader("=B1,=A1\n"), "A1")
+	if err := refused("import", sh, err, "A1", ""); err != nil {
+		return err
+	}
+	sh = strict(NewSheet(), "A1", "1", "A2", "2")
+	doc := `{"version": 1, "sheets": [{"name": "", "cells": [{"ref": "A1", "input": "=A2"}, {"ref": "A2", "input": "=A1"}]}]}`
+	if err := refused("load", sh, sh.Load(strings.NewReader(doc)), "A1", "1"); err != nil {
+		return err
+	}
+
+	book := NewWorkbook()
+	bar, _ := book.AddSheet("Bar")
+	other, _ := book.AddSheet("Other")
+	_ = bar.Set("A1", "=Foo!A1")
+	_ = other.Set("A1", "=Bar!A1")
+	_ = book.SetCalcOptions(CalcOptions{Strict: true})
+	if err := refused("rename", bar, book.RenameSheet("Other", "Foo"), "A1", "=Foo!A1"); err != nil {
+		return err
+	}
+	if other.Name() != "Other" {
+		return fmt.Errorf("rename: sheet is called %q after the refusal", other.Name())
+	}
+
+	// a cycle made before strict mode stays in the undo history
+	sh = NewSheet()
+	_ = sh.Set("C1", "=D1")
+	_ = sh.Set("D1", "=C1")
+	_ = sh.Set("D1", "5")
+	strict(sh)
+	if sh.Undo() || len(sh.DetectCycles()) > 0 || sh.Input("D1") != "5" {
+		return fmt.Errorf("undo brought back a cycle: %v", sh.DetectCycles())
+	}
+	return nil
+}
+
+// sseEvent is one server-sent event as a check's client reads it.
+type sseEvent struct {
+	name string
+	id   uint64
+	data string
+}
+
+// listenSSE opens the event stream of client and delivers its events until
+// the stream ends.
+func listenSSE(base, client string) (io.Closer, <-chan sseEvent, error) {
+	resp, err := http.Get(base + "/events?client=" + client)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, nil, fmt.Errorf("events for %s: %s", client, resp.Status)
+	}
+	events := make(chan sseEvent, 64)
+	go func() {
+		defer close(events)
+		var ev sseEvent
+		sc := bufio.NewScanner(resp.Body)
+		for sc.Scan() {
+			line := sc.Text()
+			switch {
+			case line == "":
+				events <- ev
+				ev = sseEvent{}
+			case strings.HasPrefix(line, "id: "):
+				ev.id, _ = strconv.ParseUint(line[len("id: "):], 10, 64)
+			case strings.HasPrefix(line, "event: "):
+				ev.name = line[len("event: "):]
+			case strings.HasPrefix(line, "data: "):
+				ev.data = line[len("data: "):]
+			}
+		}
+	}()
+	return resp.Body, events, nil
+}
+
+// nextSSE waits for the next event of the given name, collecting into log
+// every event received on the way.
+func nextSSE(events <-chan sseEvent, name string, log *[]sseEvent) (sseEvent, error) {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return ev, fmt.Errorf("stream ended waiting for %s", name)
+			}
+			*log = append(*log, ev)
+			if ev.name == name {
+				return ev, nil
+			}
+		case <-timeout:
+			return sseEvent{}, fmt.Errorf("no %s event within 5s", name)
+		}
+	}
+}
+
+// checkCollab drives a CollabServer over HTTP as two clients would: a stale
+// edit is rebased past a row insert, two edits of one cell resolve last
+// writer wins, an edit of a deleted row is refused, and presence follows
+// clients joining, moving and leaving. Every client sees the edits in
+// revision order.
+func checkCollab() error {
+	team := NewSheet()
+	for _, in := range [][2]string{{"A1", "rent"}, {"B1", "1200"}, {"A2", "food"}, {"B2", "300"}, {"B3", "=SUM(B1:B2)"}} {
+		_ = team.Set(in[0], in[1])
+	}
+	collab := NewCollabServer(team)
+	ts := httptest.NewServer(collab)
+	defer ts.Close()
+	defer collab.Close()
+
+	var aliceLog, bobLog []sseEvent
+	presence := func(events <-chan sseEvent, log *[]sseEvent, want string) error {
+		for {
+			ev, err := nextSSE(events, "presence", log)
+			if err != nil {
+				return fmt.Errorf("waiting for presence %s: %w", want, err)
+			}
+			if ev.data == want {
+				return nil
+			}
+		}
+	}
+	aliceStream, alice, err := listenSSE(ts.URL, "alice")
+	if err != nil {
+		return err
+	}
+	defer aliceStream.Close()
+	if ev, err := nextSSE(alice, "hello", &aliceLog); err != nil || ev.data != `{"rev":0,"client":"alice"}` {
+		return fmt.Errorf("alice's hello: %v %v", ev.data, err)
+	}
+	if err := presence(alice, &aliceLog, `[{"client":"alice"}]`); err != nil {
+		return err
+	}
+	bobStream, bob, err := listenSSE(ts.URL, "bob")
+	if err != nil {
+		return err
+	}
+	defer bobStream.Close()
+	if err := presence(alice, &aliceLog, `[{"client":"alice"},{"client":"bob"}]`); err != nil {
+		return err
+	}
+
+	post := func(path string, v any) (int, []byte, error) {
+		body, _ := json.Marshal(v)
+		resp, err := http.Post(ts.URL+path, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return 0, nil, err
+		}
+		defer resp.Body.Close()
+		reply, err := io.ReadAll(resp.Body)
+		return resp.StatusCode, reply, err
+	}
+	edit := func(e CollabEdit) (CollabResult, error) {
+		var res CollabResult
+		code, reply, err := post("/edits", e)
+		switch {
+		case err != nil:
+			return res, err
+		case code != http.StatusOK:
+			return res, fmt.Errorf("%s %s: %d %s", e.Client, e.Op, code, bytes.TrimSpace(reply))
+		}
+		return res, json.Unmarshal(reply, &res)
+	}
+	value := func(ref string, want any) error {
+		if v, _ := team.Get(ref); v != want {
+			return fmt.Errorf("%s = %v, want %v", ref, v, want)
+		}
+		return nil
+	}
+
+	// bob's edit of B2 was made at revision 0, before alice's insert
+	if _, err := edit(CollabEdit{Base: 0, Client: "alice", Op: "insertRows", At: 2, N: 1}); err != nil {
+		return err
+	}
+	res, err := edit(CollabEdit{Base: 0, Client: "bob", Op: "set", Ref: "B2", Input: "350"})
+	switch {
+	case err != nil:
+		return err
+	case res.Edit.Ref != "B3" || res.Edit.Rev != 2 || res.Overwrote != 0:
+		return fmt.Errorf("stale edit of B2 applied as %+v, want B3 at revision 2", res)
+	}
+	if err := errors.Join(value("B3", 350.0), value("B4", 1550.0)); err != nil {
+		return fmt.Errorf("after rebasing: %w", err)
+	}
+
+	// alice had not seen bob's edit of B3, so hers overwrites it
+	res, err = edit(CollabEdit{Base: 1, Client: "alice", Op: "set", Ref: "B3", Input: "400"})
+	switch {
+	case err != nil:
+		return err
+	case res.Overwrote != 2:
+		return fmt.Errorf("concurrent edit of B3 overwrote revision %d, want 2", res.Overwrote)
+	}
+	res, err = edit(CollabEdit{Base: 3, Client: "bob", Op: "set", Ref: "B3", Input: "450"})
+	switch {
+	case err != nil:
+		return err
+	case res.Overwrote != 0:
+		return fmt.Errorf("edit of B3 after seeing revision 3 overwrote revision %d", res.Overwrote)
+	}
+	if err := value("B4", 1650.0); err != nil {
+		return fmt.Errorf("last writer: %w", err)
+	}
+
+	// bob edits the row alice deleted without seeing it
+	if _, err := edit(CollabEdit{Base: 4, Client: "alice", Op: "deleteRows", At: 3, N: 1}); err != nil {
+		return err
+	}
+	code, _, err := post("/edits", CollabEdit{Base: 4, Client: "bob", Op: "set", Ref: "B3", Input: "500"})
+	if err != nil || code != http.StatusConflict {
+		return fmt.Errorf("edit of a deleted row: %d %v, want 409", code, err)
+	}
+
+	if code, _, err := post("/presence", Presence{"bob", "b2"}); err != nil || code != http.StatusNoContent {
+		return fmt.Errorf("moving bob's cursor: %d %v", code, err)
+	}
+	if err := presence(alice, &aliceLog, `[{"client":"alice"},{"client":"bob","cursor":"B2"}]`); err != nil {
+		return err
+	}
+	if err := presence(bob, &bobLog, `[{"client":"alice"},{"client":"bob","cursor":"B2"}]`); err != nil {
+		return err
+	}
+	bobStream.Close()
+	if err := presence(alice, &aliceLog, `[{"client":"alice"}]`); err != nil {
+		return fmt.Errorf("after bob left: %w", err)
+	}
+
+	// both saw revisions 1 to 5 in order, each with its revision as the id
+	for client, log := range map[string][]sseEvent{"alice": aliceLog, "bob": bobLog} {
+		var revs []uint64
+		for _, ev := range log {
+			if ev.name != "edit" {
+				continue
+			}
+			var e CollabEdit
+			if err := json.Unmarshal([]byte(ev.data), &e); err != nil || e.Rev != ev.id {
+				return fmt.Errorf("%s got edit %q with id %d", client, ev.data, ev.id)
+			}
+			revs = append(revs, ev.id)
+		}
+		if !slices.Equal(revs, []uint64{1, 2, 3, 4, 5}) {
+			return fmt.Errorf("%s saw revisions %v, want 1 to 5 in order", client, revs)
+		}
+	}
+	return nil
+}
+
+// checkXLSXErrors writes every error value, as typed and as a formula
+// result, and expects the worksheet to hold only error codes OOXML knows.
+func checkXLSXErrors() error {
+	sh := NewSheet()
+	for i, e := range cellErrors {
+		_ = sh.Set(cellName(i+1, 1), string(e))
+	}
+	_ = sh.Set("B1", "=B2")
+	_ = sh.Set("B2", "=B1")
+	var buf bytes.Buffer
+	if err := WriteXLSX(&buf, []NamedSheet{{"Errors", sh}}); err != nil {
+		return err
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		return err
+	}
+	f, err := zr.Open("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var ws struct {
+		Cells []struct {
+			Ref   string `xml:"r,attr"`
+			Type  string `xml:"t,attr"`
+			Value string `xml:"v"`
+		} `xml:"sheetData>row>c"`
+	}
+	if err := xml.NewDecoder(f).Decode(&ws); err != nil {
+		return err
+	}
+	errs := 0
+	for _, c := range ws.Cells {
+		if c.Type != "e" {
+			continue
+		}
+		if !xlsxErrors[CellError(c.Value)] {
+			return fmt.Errorf("%s holds the error %s, which OOXML does not have", c.Ref, c.Value)
+		}
+		errs++
+	}
+	if errs != len(xlsxErrors) {
+		return fmt.Errorf("wrote %d error cells, want %d", errs, len(xlsxErrors))
+	}
+	return nil
+}
+
+// checkDates covers the edges of DATE and DATEDIF: month ends, leap years
+// and years out of range.
+func checkDates() error {
+	sh := NewSheet()
+	for _, c := range []struct {
+		formula string
+		want    any
+	}{
+		{`=DATEDIF(DATE(2024,1,31),DATE(2024,3,1),"MD")`, 1.0},
+		{`=DATEDIF(DATE(2023,1,31),DATE(2023,3,1),"MD")`, 1.0},
+		{`=DATEDIF(DATE(2024,1,15),DATE(2024,3,10),"MD")`, 24.0},
+		{`=DATEDIF(DATE(2024,1,31),DATE(2024,3,1),"M")`, 1.0},
+		{`=DATEDIF(DATE(2020,2,29),DATE(2024,2,28),"Y")`, 3.0},
+		{`=DATE(2024,14,31)`, 45719.0},
+		{`=DATE(100,1,1)`, 36526.0},
+		{`=DATE(-1,1,1)`, ErrNum},
+		{`=DATE(-2000,1,1)`, ErrNum},
+		{`=YEAR(2958465)`, 9999.0},
+		{`=YEAR(2958466)`, ErrNum},
+		{`=YEAR(1e300)`, ErrNum},
+		{`=TEXT(1e300,"yyyy-mm-dd")`, ErrNum},
+		{`=TEXT(-1,"yyyy")`, ErrNum},
+		{`=TEXT(2958465,"yyyy-mm-dd")`, "9999-12-31"},
+	} {
+		_ = sh.Set("A1", c.formula)
+		if v, _ := sh.Get("A1"); v != c.want {
+			return fmt.Errorf("%s = %v, want %v", c.formula, v, c.want)
+		}
+	}
+	return nil
+}
+
+// checkTextCounts passes LEFT, RIGHT and MID counts far beyond any text,
+// which must clamp rather than overflow.
+func checkTextCounts() error {
+	sh := NewSheet()
+	for _, c := range []struct {
+		formula string
+		want    any
+	}{
+		{`=LEFT("abc",1e20)`, "abc"},
+		{`=RIGHT("abc",1e20)`, "abc"},
+		{`=MID("abc",2,1e20)`, "bc"},
+		{`=MID("abc",1e20,1e20)`, ""},
+		{`=MID("abc",2,1)`, "b"},
+		{`=LEFT("abc",-1)`, ErrValue},
+	} {
+		_ = sh.Set("A1", c.formula)
+		if v, _ := sh.Get("A1"); v != c.want {
+			return fmt.Errorf("%s = %v, want %v", c.formula, v, c.want)
+		}
+	}
+	return nil
+}
+
+// checkArithmeticRange expects #NUM! wherever arithmetic leaves the finite
+// numbers, and that error rather than NaN or infinity in what reads it.
+func checkArithmeticRange() error {
+	sh := NewSheet()
+	_ = sh.Set("B1", "=A1")
+	_ = sh.Set("C1", "=SUM(A1,1)")
+	for _, c := range []struct {
+		formula string
+		want    any
+	}{
+		{"=(-8)^0.5", ErrNum},
+		{"=1e308*10", ErrNum},
+		{"=-1e308-1e308", ErrNum},
+		{"=1e308/1e-10", ErrNum},
+		{"=0^-1", ErrNum},
+		{"=(-8)^(1/3)", ErrNum},
+		{"=SUM(1e308,1e308)", ErrNum},
+		{"=AVERAGE(1e308,1e308)", ErrNum},
+		{"=2^10", 1024.0},
+		{"=1/0", ErrDiv0},
+	} {
+		_ = sh.Set("A1", c.formula)
+		for _, ref := range []string{"A1", "B1", "C1"} {
+			v, _ := sh.Get(ref)
+			if want, isErr := c.want.(CellError); isErr && v != want || !isErr && ref == "A1" && v != c.want {
+				return fmt.Errorf("%s with A1 %s = %v, want %v", ref, c.formula, v, c.want)
+			}
+		}
+	}
+	return nil
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		var err error
+		switch os.Args[1] {
+		case "tui":
+			err = runTUI(os.Args[2:])
+		case "serve":
+			err = runCollab(os.Args[2:])
+		case "check":
+			err = runChecks()
+		default:
+			err = fmt.Errorf("unknown command %q (want tui, serve or check)", os.Args[1])
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	s := NewSheet()
+	_ = s.Set("A1", "5")
+	_ = s.Set("B1", "10")
+	_ = s.Set("C1", "=A1+B1")
+	_ = s.Set("D1", "=C1*2")
+	_ = s.Set("E1", "=D1/A1")
+
+	fmt.Println("initial sheet")
+	s.Print()
+
+	// update A1; dependents auto-dirty
+	_ = s.Set("A1", "20")
+	fmt.Println("\nafter A1=20")
+	s.Print()
+
+	// introduce a cycle
 	_ = s.Set("B2", "=C2")
 	_ = s.Set("C2", "=B2")
 	fmt.Println("\nwith cycle (B2<->C2)")
 	s.Print()
+
+	// precedence, parentheses and unary minus
+	_ = s.Set("A3", "=A1+B1*2")
+	_ = s.Set("B3", "=(A1+B1)/2")
+	_ = s.Set("C3", "=-A1")
+	_ = s.Set("D3", "=-2^2")
+	_ = s.Set("E3", "=(A1+")
+	fmt.Println("\nprecedence row 3")
+	s.Print()
+	_, err := s.Get("E3")
+	fmt.Println("E3:", err)
+
+	// ranges and aggregates; A5 is text and C5 is blank, both skipped
+	_ = s.Set("A4", "=SUM(A1:E1)")
+	_ = s.Set("B4", "=AVERAGE(A1:B1, 30)")
+	_ = s.Set("C4", "=MIN(A1:E1)")
+	_ = s.Set("D4", "=MAX(A1:E1)")
+	_ = s.Set("E4", "=COUNT(A1:E1, A5:C5)")
+	_ = s.Set("A5", "text")
+	_ = s.Set("B5", "=SUM(A1:A1000000)")
+	fmt.Println("\nwith aggregates in rows 4-5")
+	s.Print()
+	_ = s.Set("A1000", "1000") // far inside B5's range, never listed in deps
+	v, _ := s.Get("B5")
+	fmt.Println("B5 after A1000=1000:", v)
+
+	// comparisons, text and logical functions
+	_ = s.Set("A6", `="Total: "&TEXT(A4,"#,##0.00")`)
+	_ = s.Set("B6", `=IF(A1>B1,"A wins","B wins")`)
+	_ = s.Set("C6", `=AND(A1>0, B1<>"x", TRUE)`)
+	_ = s.Set("D6", `=IFERROR(A1/0, "n/a")`)
+	_ = s.Set("E6", `=MID(UPPER(CONCAT(A5, "-", A1)), 2, 5)&LEN(A5)`)
+	fmt.Println("\ntext and logic in row 6")
+	for col := 1; col <= 5; col++ {
+		v, _ := s.Get(cellName(6, col))
+		fmt.Printf("%s = %v\n", cellName(6, col), v)
+	}
+
+	// typed errors propagate and can be caught
+	_ = s.Set("A7", "#ERR!") // plain text, not an error
+	_ = s.Set("B7", "=A1/(B1-10)")
+	_ = s.Set("C7", "=B7+1")
+	_ = s.Set("D7", "=ISERROR(C7)")
+	_ = s.Set("E7", "=NOPE(1)")
+	fmt.Println("\nerror values in row 7")
+	for col := 1; col <= 5; col++ {
+		v, _ := s.Get(cellName(7, col))
+		fmt.Printf("%s = %v (%T)\n", cellName(7, col), v, v)
+	}
+	v, _ = s.Get("B2")
+	fmt.Printf("B2 = %v (%T)\n", v, v)
+
+	// concurrent readers while a writer recalculates a wide fan-out
+	wide := NewSheet()
+	_ = wide.Set("A1", "1")
+	for r := 2; r <= 500; r++ {
+		_ = wide.Set(cellName(r, 1), fmt.Sprintf("=A1*%d", r))
+	}
+	_ = wide.Set("B1", "=SUM(A1:A500)")
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				_, _ = wide.Get(cellName(j%500+1, 1))
+			}
+		}()
+	}
+	for k := 2; k <= 20; k++ {
+		_ = wide.Set("A1", strconv.Itoa(k))
+	}
+	wg.Wait()
+	v, _ = wide.Get("B1")
+	fmt.Println("\nSUM of 20*(1..500):", displayText(v)) // 2505000
+
+	// CSV round trip
+	sheet := NewSheet()
+	_ = sheet.ImportCSV(strings.NewReader("item,qty,price,total\nnuts,3,1.5,=B2*C2\nbolts,10,0.25,=B3*C3\n\"TRUE\",,,=SUM(D2:D3)\n"), "A1")
+	var out strings.Builder
+	_ = sheet.ExportCSV(&out, "", CSVValues)
+	fmt.Print("\nCSV values:\n", out.String())
+	out.Reset()
+	_ = sheet.ExportCSV(&out, "A2:D4", CSVFormulas)
+	fmt.Print("CSV formulas A2:D4:\n", out.String())
+
+	// XLSX round trip with two worksheets
+	var xlsx bytes.Buffer
+	if err := WriteXLSX(&xlsx, []NamedSheet{{"Orders", sheet}, {"Errors & text", s}}); err != nil {
+		panic(err)
+	}
+	loaded, err := ReadXLSX(bytes.NewReader(xlsx.Bytes()), int64(xlsx.Len()))
+	if err != nil {
+		panic(err)
+	}
+	for _, b := range loaded.Sheets() {
+		used, _ := b.usedRange()
+		d4, _ := b.Get("D4")
+		a7, _ := b.Get("A7")
+		fmt.Printf("xlsx sheet %q used %v: D4=%v A7=%v (%T)\n", b.Name(), used, displayText(d4), a7, a7)
+	}
+
+	// workbook with cross-sheet references
+	book := NewWorkbook()
+	budget, _ := book.AddSheet("Budget")
+	_ = budget.Set("B3", "=SUM('Q1 Data'!A1:A3)*Rate!A1")
+	q1, _ := book.AddSheet("Q1 Data")
+	for i, amount := range []string{"100", "250", "75"} {
+		_ = q1.Set(cellName(i+1, 1), amount)
+	}
+	summary, _ := book.AddSheet("Summary")
+	_ = summary.Set("A1", `="Budget: "&Budget!B3`)
+	show := func(label string) {
+		out.Reset()
+		_ = budget.ExportCSV(&out, "B3", CSVFormulas)
+		v, _ := summary.Get("A1")
+		fmt.Printf("%-16s Budget!B3 %s  Summary!A1 = %v\n", label, strings.TrimSpace(out.String()), v)
+	}
+	fmt.Println("\nworkbook")
+	show("no Rate sheet:")
+	rate, _ := book.AddSheet("Rate")
+	_ = rate.Set("A1", "1.1")
+	show("Rate added:")
+	_ = q1.Set("A2", "300")
+	show("Q1 A2=300:")
+	_ = book.RenameSheet("Q1 Data", "Q1 Actuals")
+	show("renamed:")
+
+	xlsx.Reset()
+	if err := book.WriteXLSX(&xlsx); err != nil {
+		panic(err)
+	}
+	_ = book.DeleteSheet("Rate")
+	show("Rate deleted:")
+	fmt.Println("Set on deleted sheet:", rate.Set("A1", "2"))
+
+	loaded, err = ReadXLSX(bytes.NewReader(xlsx.Bytes()), int64(xlsx.Len()))
+	if err != nil {
+		panic(err)
+	}
+	v, _ = loaded.Sheet("summary").Get("A1")
+	fmt.Println("xlsx round trip Summary!A1 =", v)
+
+	// inserting and deleting rows and columns rewrites references
+	grid := NewSheet()
+	for r := 1; r <= 5; r++ {
+		_ = grid.Set(cellName(r, 1), strconv.Itoa(r*10))
+	}
+	_ = grid.Set("B1", "=SUM(A1:A5)")
+	_ = grid.Set("C1", "=A3*2")
+	_ = grid.Set("D1", "=SUM(A2:A3)")
+	layout := func(label string) {
+		out.Reset()
+		_ = grid.ExportCSV(&out, "", CSVFormulas)
+		fmt.Printf("%s\n%s", label, out.String())
+	}
+	fmt.Println()
+	layout("before:")
+	_ = grid.InsertRows(3, 2)
+	layout("2 rows inserted at 3:")
+	_ = grid.DeleteRows(4, 3)
+	layout("rows 4-6 deleted:")
+	_ = grid.InsertColumns(1, 1)
+	_ = grid.DeleteColumns(4, 1)
+	layout("column inserted before A, then D deleted:")
+
+	// relative references follow a paste, $-anchored ones stay put
+	prices := NewSheet()
+	_ = prices.ImportCSV(strings.NewReader("qty,price,net,gross\n2,1.5,=A2*B2,=C2*(1+$F$1)\n4,0.25\n10,3\n"), "A1")
+	_ = prices.Set("E1", "vat")
+	_ = prices.Set("F1", "0.2")
+	_ = prices.FillDown("C2:D4")
+	_ = prices.Copy("C2:D2", "C6")
+	_ = prices.Set("A5", "=SUM(A$2:A4)")
+	_ = prices.FillRight("A5:D5")
+	out.Reset()
+	_ = prices.ExportCSV(&out, "A1:D6", CSVFormulas)
+	fmt.Print("\nfill and copy:\n", out.String())
+	out.Reset()
+	_ = prices.ExportCSV(&out, "A1:D6", CSVValues)
+	fmt.Print(out.String())
+
+	// undo and redo, with a batch undone as one step
+	total := func() any { v, _ := prices.Get("D5"); return v }
+	fmt.Println("\ngross total:", total())
+	prices.BeginBatch()
+	_ = prices.Set("F1", "0.1")
+	_ = prices.DeleteRows(3, 1)
+	prices.EndBatch()
+	total = func() any { v, _ := prices.Get("D4"); return v }
+	fmt.Println("vat 10% and row 3 deleted:", total())
+	prices.Undo()
+	v, _ = prices.Get("D5")
+	fmt.Println("undo:", v)
+	prices.Redo()
+	fmt.Println("redo:", total())
+	prices.Undo()
+	prices.Undo() // the FillRight of row 5
+	v, _ = prices.Get("D5")
+	fmt.Printf("undo twice: D5=%q\n", v)
+
+	// defined names
+	sales := NewSheet()
+	_ = sales.ImportCSV(strings.NewReader("month,revenue\nJan,1200\nFeb,900\nMar,1500\n"), "A1")
+	_ = sales.DefineName("Revenue", "B2:B4")
+	_ = sales.DefineName("TaxRate", "0.2")
+	_ = sales.Set("D1", "=SUM(Revenue)*(1-TaxRate)")
+	_ = sales.Set("D2", "=TaxRate*Bonus")
+	net := func(label string) {
+		d1, _ := sales.Get("D1")
+		d2, _ := sales.Get("D2")
+		fmt.Printf("%-22s net=%v D2=%v\n", label, d1, d2)
+	}
+	fmt.Println()
+	net("names:")
+	_ = sales.DefineName("TaxRate", "0.25")
+	net("TaxRate redefined:")
+	_ = sales.InsertRows(4, 1)
+	_ = sales.Set("B4", "400")
+	net("row inserted in range:")
+	fmt.Println("self reference:", sales.DefineName("TaxRate", "TaxRate*2"))
+
+	// subscribers hear only about values that actually changed
+	unsubscribe, _ := sales.Subscribe("D1:D2", func(changes []CellChange) {
+		for _, ch := range changes {
+			fmt.Printf("  %s: %v -> %v\n", ch.Ref, ch.Old, ch.New)
+		}
+	})
+	fmt.Println("\nMar revenue 1500 -> 1600:")
+	_ = sales.Set("B5", "1600")
+	fmt.Println("Apr added outside the named range (no change):")
+	_ = sales.Set("B6", "700")
+	fmt.Println("Bonus defined:")
+	_ = sales.DefineName("Bonus", "100")
+	unsubscribe()
+
+	// any range renders with headers, auto widths and alignment
+	fmt.Println()
+	_ = sales.Render(os.Stdout, "A1:D6")
+
+	// the terminal viewer, driven here by a scripted key sequence: go down
+	// to A7 and type a label, enter a formula in B7 (fixing a typo with
+	// Backspace), then change B5 and undo that change
+	keys := strings.Repeat("\x1b[B", 6) + "Total\r" +
+		"\x1b[A\t=SUM(B2:B5\x7f6)\r" +
+		"\x1b[A\x1b[A\x1b[A\r\x7f\x7f\x7f\x7f2000\r\x1a\x11"
+	_ = sales.tui(strings.NewReader(keys), io.Discard, 10, 4)
+	fmt.Println()
+	_ = sales.Render(os.Stdout, "A5:B7")
+
+	// number formats change what Display shows, never the typed value
+	loan := NewSheet()
+	_ = loan.Set("A1", "2024-03-15")
+	_ = loan.Set("A2", "=DATE(2024,14,31)") // month 14 rolls into 2025
+	_ = loan.Set("A3", `=DATEDIF(A1,A2,"M")&" months"`)
+	_ = loan.Set("B1", "250000")
+	_ = loan.Set("B2", "-1234.5")
+	_ = loan.Set("B3", "0.0425")
+	_ = loan.Set("B4", "=YEAR(A2)-YEAR(A1)")
+	_ = loan.SetFormat("B1:B2", "$#,##0.00;($#,##0.00)")
+	_ = loan.SetFormat("B3", "0.00%")
+	_ = loan.SetFormat("A1", "d mmm yyyy")
+	fmt.Println()
+	for _, ref := range []string{"A1", "A2", "A3", "B1", "B2", "B3", "B4"} {
+		v, _ := loan.Get(ref)
+		d, _ := loan.Display(ref)
+		fmt.Printf("%s %-12v %s\n", ref, v, d)
+	}
+
+	// a JSON document keeps inputs, formats and names; loading recalculates
+	var doc bytes.Buffer
+	_ = loan.DefineName("Rate", "B3")
+	_ = loan.Set("B5", "=B1*Rate")
+	_ = loan.SetFormat("B5", "$#,##0.00")
+	_ = loan.Save(&doc)
+	restored := NewSheet()
+	if err := restored.Load(&doc); err != nil {
+		fmt.Println("load:", err)
+	}
+	_ = restored.Set("B1", "300000")
+	interest, _ := restored.Display("B5")
+	since, _ := restored.Display("A1")
+	fmt.Println("\nrestored, principal 300000: interest", interest, "since", since)
+
+	// two people edit one sheet over HTTP. Bob's edits were made at
+	// revision 0 and are rebased past Alice's row insert; Alice's edit of
+	// the cell Bob changed wins, and Bob's edit of a row Alice deleted is
+	// refused.
+	team := NewSheet()
+	_ = team.Set("A1", "rent")
+	_ = team.Set("B1", "1200")
+	_ = team.Set("A2", "food")
+	_ = team.Set("B2", "300")
+	_ = team.Set("A3", "total")
+	_ = team.Set("B3", "=SUM(B1:B2)")
+	collab := NewCollabServer(team)
+	ts := httptest.NewServer(collab)
+
+	bobStream, bobSaw, err := listenSSE(ts.URL, "bob")
+	if err != nil {
+		panic(err)
+	}
+	aliceStream, _, err := listenSSE(ts.URL, "alice")
+	if err != nil {
+		panic(err)
+	}
+
+	post := func(path string, v any) string {
+		body, _ := json.Marshal(v)
+		resp, err := http.Post(ts.URL+path, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return err.Error()
+		}
+		defer resp.Body.Close()
+		reply, _ := io.ReadAll(resp.Body)
+		return strings.TrimSpace(fmt.Sprintf("%d %s", resp.StatusCode, reply))
+	}
+	fmt.Println()
+	for _, e := range []CollabEdit{
+		{Base: 0, Client: "alice", Op: "insertRows", At: 2, N: 1},
+		{Base: 1, Client: "alice", Op: "set", Ref: "A2", Input: "power"},
+		{Base: 2, Client: "alice", Op: "set", Ref: "B2", Input: "90"},
+		{Base: 0, Client: "bob", Op: "set", Ref: "B2", Input: "350"},
+		{Base: 0, Client: "bob", Op: "set", Ref: "C2", Input: "=B2/B3"},
+		{Base: 3, Client: "alice", Op: "set", Ref: "B3", Input: "400"},
+		{Base: 6, Client: "alice", Op: "deleteRows", At: 2, N: 1},
+		{Base: 5, Client: "bob", Op: "set", Ref: "A2", Input: "utilities"},
+	} {
+		fmt.Printf("%-5s %-10s %s\n", e.Client, e.Op, post("/edits", e))
+	}
+	fmt.Println("presence", post("/presence", Presence{"bob", "b3"}))
+
+	collab.Close()
+	var saw []string
+	for ev := range bobSaw {
+		if ev.id > 0 {
+			ev.name += fmt.Sprintf("#%d", ev.id)
+		}
+		saw = append(saw, ev.name)
+	}
+	bobStream.Close()
+	aliceStream.Close()
+	ts.Close()
+	fmt.Println("bob saw:", strings.Join(saw, " "))
+	_ = team.Render(os.Stdout, "")
+
+	// lookups depend on their whole table, so editing any row re-runs them
+	pricing := NewWorkbook()
+	rates, _ := pricing.AddSheet("Rates")
+	order, _ := pricing.AddSheet("Order")
+	for i, row := range [][2]string{{"0", "0.00"}, {"100", "0.05"}, {"500", "0.10"}, {"1000", "0.15"}} {
+		_ = rates.Set(cellName(i+1, 1), row[0])
+		_ = rates.Set(cellName(i+1, 2), row[1])
+	}
+	_ = order.Set("A1", "640")
+	_ = order.Set("B1", "=VLOOKUP(A1,Rates!A1:B4,2)")
+	_ = order.Set("C1", "=INDEX(Rates!A1:A4,MATCH(A1,Rates!A1:A4))")
+	_ = order.Set("D1", `=XLOOKUP(A1,Rates!A1:A4,Rates!B1:B4,"none",1)`)
+	_ = order.Set("E1", "=VLOOKUP(A1,Rates!A1:B4,2,FALSE)")
+	quote := func(label string) {
+		var vals []string
+		for _, ref := range []string{"B1", "C1", "D1", "E1"} {
+			v, _ := order.Get(ref)
+			vals = append(vals, fmt.Sprintf("%s=%v", ref, v))
+		}
+		fmt.Printf("%-22s %s\n", label, strings.Join(vals, " "))
+	}
+	fmt.Println()
+	quote("640:")
+	_ = rates.Set("A3", "700")
+	quote("tier 500 moved to 700:")
+	_ = rates.Set("A4", "640")
+	quote("tier 1000 now 640:")
+
+	// auditing: what feeds a cell, what it feeds, and where the cycles are
+	feeds, _ := s.Precedents("D1", true)
+	fed, _ := s.Dependents("A1", true)
+	fmt.Println("\nD1 reads", feeds)
+	fmt.Println("A1 feeds", fed)
+	fmt.Println("cycles", s.DetectCycles())
+	fmt.Println()
+	_ = order.WriteDOT(os.Stdout)
+
+	// interest on the average balance is circular: the closing balance
+	// includes the interest that depends on it
+	acct := NewSheet()
+	_ = acct.Set("A1", "1000")          // opening
+	_ = acct.Set("A2", "500")           // deposits
+	_ = acct.Set("A3", "0.05")          // rate
+	_ = acct.Set("B1", "=A3*(A1+B2)/2") // interest
+	_ = acct.Set("B2", "=A1+A2+B1")     // closing
+	_ = acct.SetFormat("B1:B2", "#,##0.00")
+	balances := func(label string) {
+		interest, _ := acct.Display("B1")
+		closing, _ := acct.Display("B2")
+		fmt.Printf("%-10s interest %s closing %s\n", label, interest, closing)
+	}
+	fmt.Println()
+	balances("default:")
+	_ = acct.SetCalcOptions(CalcOptions{Iterative: true, MaxChange: 1e-9})
+	balances("iterative:")
+	fmt.Println("strict:", acct.SetCalcOptions(CalcOptions{Strict: true}))
+	_ = acct.Set("B1", "=A3*A1") // interest on the opening balance only
+	_ = acct.SetCalcOptions(CalcOptions{Strict: true})
+	fmt.Println("strict:", acct.Set("A1", "=B2-A2"))
 }